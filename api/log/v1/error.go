@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
 	status "google.golang.org/grpc/status"
 )
 
@@ -36,3 +37,149 @@ func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
 func (e ErrOffsetOutOfRange) Error() string {
 	return e.GRPCStatus().Err().Error()
 }
+
+// ErrCorruptRecord is returned when a record read back from disk fails its
+// checksum or has a header this version doesn't understand. Pos is the
+// record's position in its store file.
+type ErrCorruptRecord struct {
+	Offset uint64
+	Pos    uint64
+}
+
+func (e ErrCorruptRecord) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.DataLoss,
+		fmt.Sprintf("corrupt record at offset %d", e.Offset),
+	)
+
+	msg := fmt.Sprintf(
+		"The record at offset %d failed its integrity check",
+		e.Offset)
+
+	d := &errdetails.LocalizedMessage{Locale: "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+
+	if err != nil {
+		return st
+	}
+
+	return std
+}
+
+func (e ErrCorruptRecord) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrLogEmpty is returned for the highest offset of a log that holds no
+// records.
+type ErrLogEmpty struct{}
+
+func (e ErrLogEmpty) GRPCStatus() *status.Status {
+	return status.New(codes.NotFound, "log is empty")
+}
+
+func (e ErrLogEmpty) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrTopicNotFound is returned for requests to a topic that doesn't exist.
+type ErrTopicNotFound struct {
+	Topic string
+}
+
+func (e ErrTopicNotFound) GRPCStatus() *status.Status {
+	return status.New(
+		codes.NotFound,
+		fmt.Sprintf("topic not found: %s", e.Topic),
+	)
+}
+
+func (e ErrTopicNotFound) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrTopicExists is returned when creating a topic that already exists.
+type ErrTopicExists struct {
+	Topic string
+}
+
+func (e ErrTopicExists) GRPCStatus() *status.Status {
+	return status.New(
+		codes.AlreadyExists,
+		fmt.Sprintf("topic already exists: %s", e.Topic),
+	)
+}
+
+func (e ErrTopicExists) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrInvalidTopic is returned when creating a topic whose name isn't
+// valid. Names are made of letters, digits, dots, dashes and underscores.
+type ErrInvalidTopic struct {
+	Topic string
+}
+
+func (e ErrInvalidTopic) GRPCStatus() *status.Status {
+	return status.New(
+		codes.InvalidArgument,
+		fmt.Sprintf("invalid topic name: %q", e.Topic),
+	)
+}
+
+func (e ErrInvalidTopic) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrDefaultTopic is returned when deleting the default topic, which
+// requests without a topic rely on.
+type ErrDefaultTopic struct{}
+
+func (e ErrDefaultTopic) GRPCStatus() *status.Status {
+	return status.New(
+		codes.InvalidArgument,
+		"the default topic can't be deleted",
+	)
+}
+
+func (e ErrDefaultTopic) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrTooManyPartitions is returned when creating a topic with more
+// partitions than the server allows.
+type ErrTooManyPartitions struct {
+	Partitions uint32
+	Max        uint32
+}
+
+func (e ErrTooManyPartitions) GRPCStatus() *status.Status {
+	return status.New(
+		codes.InvalidArgument,
+		fmt.Sprintf("too many partitions: %d, at most %d", e.Partitions, e.Max),
+	)
+}
+
+func (e ErrTooManyPartitions) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrPartitionNotFound is returned for requests to a partition the topic
+// doesn't have.
+type ErrPartitionNotFound struct {
+	Topic     string
+	Partition uint32
+}
+
+func (e ErrPartitionNotFound) GRPCStatus() *status.Status {
+	return status.New(
+		codes.NotFound,
+		fmt.Sprintf("partition not found: %s/%d", e.Topic, e.Partition),
+	)
+}
+
+func (e ErrPartitionNotFound) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
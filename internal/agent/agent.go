@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"time"
 
 	api "github.com/hindenbug/dlog/api/log/v1"
 	"github.com/hindenbug/dlog/internal/auth"
@@ -19,7 +20,7 @@ import (
 type Agent struct {
 	Config
 
-	log        *log.Log
+	topics     *log.Topics
 	server     *grpc.Server
 	membership *discovery.Membership
 	replicator *log.Replicator
@@ -39,6 +40,14 @@ type Config struct {
 	StartJoinAddrs  []string
 	ACLModelFile    string
 	ACLPolicyFile   string
+	// LogConfig configures the log of each of the agent's topics,
+	// including its retention policies, which are applied every
+	// RetentionCheckInterval.
+	LogConfig              log.Config
+	RetentionCheckInterval time.Duration
+	// MaxInFlight is how many requests each ProduceStream reads ahead of
+	// the one it's appending. server.DefaultMaxInFlight if zero.
+	MaxInFlight int
 }
 
 func (c Config) RPCAddr() (string, error) {
@@ -80,16 +89,21 @@ func (a *Agent) setupLogger() error {
 	return nil
 }
 
+// setupLog opens the agent's topics, each in a subdirectory of DataDir.
 func (a *Agent) setupLog() (err error) {
-	a.log, err = log.NewLog(a.Config.DataDir, log.Config{})
+	a.topics, err = log.NewTopics(a.Config.DataDir, log.TopicsConfig{
+		Log:           a.Config.LogConfig,
+		CleanInterval: a.Config.RetentionCheckInterval,
+	})
 	return err
 }
 
 func (a *Agent) setupServer() (err error) {
 	authorizer := auth.New(a.Config.ACLModelFile, a.Config.ACLPolicyFile)
 	serverConfig := &server.Config{
-		CommitLog:  a.log,
-		Authorizer: authorizer,
+		Topics:      a.topics,
+		Authorizer:  authorizer,
+		MaxInFlight: a.Config.MaxInFlight,
 	}
 	var opts []grpc.ServerOption
 	if a.Config.ServerTLSConfig != nil {
@@ -162,7 +176,8 @@ func (a *Agent) Shutdown() (err error) {
 			a.server.GracefulStop()
 			return nil
 		},
-		a.log.Close,
+		a.topics.Sync,
+		a.topics.Close,
 	}
 	for _, fn := range shutdown {
 		if err = fn(); err != nil {
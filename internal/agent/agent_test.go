@@ -12,6 +12,7 @@ import (
 	api "github.com/hindenbug/dlog/api/log/v1"
 	"github.com/hindenbug/dlog/internal/agent"
 	"github.com/hindenbug/dlog/internal/config"
+	"github.com/hindenbug/dlog/internal/log"
 	"github.com/stretchr/testify/require"
 	"github.com/travisjeffery/go-dynaport"
 	"google.golang.org/grpc"
@@ -107,6 +108,102 @@ func TestAgent(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, consumeResponse.Record.Value, []byte("foo"))
 
+	// Other topics and partitions are replicated too, topics being created
+	// on the followers as they're found.
+	_, err = leaderClient.CreateTopic(
+		context.Background(),
+		&api.CreateTopicRequest{Topic: "orders", Partitions: 2},
+	)
+	require.NoError(t, err)
+	partition := uint32(1)
+	produceResponse, err = leaderClient.Produce(
+		context.Background(),
+		&api.ProduceRequest{
+			Topic:     "orders",
+			Partition: &partition,
+			Record: &api.Record{
+				Value: []byte("bar"),
+			},
+		},
+	)
+	require.NoError(t, err)
+
+	time.Sleep(3 * time.Second)
+
+	consumeResponse, err = followerClient.Consume(
+		context.Background(),
+		&api.ConsumeRequest{
+			Topic:     "orders",
+			Partition: partition,
+			Offset:    produceResponse.Offset,
+		},
+	)
+	require.NoError(t, err)
+	require.Equal(t, consumeResponse.Record.Value, []byte("bar"))
+}
+
+func TestAgentLegacyDataDir(t *testing.T) {
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		Server:        true,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+
+	peerTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.RootClientCertFile,
+		KeyFile:       config.RootClientKeyFile,
+		CAFile:        config.CAFile,
+		Server:        false,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+
+	// Before topics, the agent kept its log's segments directly in its
+	// data directory.
+	dataDir, err := ioutil.TempDir("", "agent-legacy-test-log")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+	clog, err := log.NewLog(dataDir, log.Config{})
+	require.NoError(t, err)
+	_, err = clog.Append(&api.Record{Value: []byte("foo")})
+	require.NoError(t, err)
+	require.NoError(t, clog.Close())
+
+	ports := dynaport.Get(2)
+	agent, err := agent.New(agent.Config{
+		ServerTLSConfig: serverTLSConfig,
+		PeerTLSConfig:   peerTLSConfig,
+		DataDir:         dataDir,
+		BindAddr:        fmt.Sprintf("%s:%d", "127.0.0.1", ports[0]),
+		RPCPort:         ports[1],
+		NodeName:        "0",
+		ACLModelFile:    config.ACLModelFile,
+		ACLPolicyFile:   config.ACLPolicyFile,
+	})
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, agent.Shutdown())
+	}()
+
+	// The old log's records are in the default topic, and new ones follow
+	// them.
+	client := client(t, agent, peerTLSConfig)
+	consumeResponse, err := client.Consume(
+		context.Background(),
+		&api.ConsumeRequest{Offset: 0},
+	)
+	require.NoError(t, err)
+	require.Equal(t, []byte("foo"), consumeResponse.Record.Value)
+
+	produceResponse, err := client.Produce(
+		context.Background(),
+		&api.ProduceRequest{Record: &api.Record{Value: []byte("bar")}},
+	)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), produceResponse.Offset)
 }
 
 func client(t *testing.T, agent *agent.Agent, tlsConfig *tls.Config) api.LogClient {
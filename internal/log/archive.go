@@ -0,0 +1,344 @@
+package log
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+const (
+	// cacheDir is where archived segments are fetched back into.
+	cacheDir = "cache"
+	// archivedExt is the extension of the marker that takes the place of
+	// an archived segment's files in the log's directory.
+	archivedExt = ".archived"
+)
+
+// SegmentArchiver stores closed segments' files somewhere cheaper than
+// the log's directory, such as an object store. Files are stored under
+// the names they have in the log's directory, so each log needs an
+// archiver of its own, or a name prefix of its own like Topics gives each
+// topic. Names use slashes to separate prefixes.
+type SegmentArchiver interface {
+	// Put stores the contents of r under name, replacing whatever was
+	// stored under it before. It returns once they're stored durably.
+	Put(name string, r io.Reader) error
+	// Get returns the contents stored under name.
+	Get(name string) (io.ReadCloser, error)
+	// Delete removes what's stored under name. Deleting a name that
+	// isn't stored isn't an error.
+	Delete(name string) error
+}
+
+// LocalArchiver is a SegmentArchiver that stores files in a directory, for
+// instance on a cheaper disk, or standing in for an object store.
+type LocalArchiver struct {
+	Dir string
+}
+
+var _ SegmentArchiver = (*LocalArchiver)(nil)
+
+// Put writes the file to a temporary name first so a failed Put never
+// leaves a partial file under name.
+func (a *LocalArchiver) Put(name string, r io.Reader) error {
+	dir, base := path.Split(path.Join(a.Dir, name))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(dir, base+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err = io.Copy(f, r); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path.Join(a.Dir, name))
+}
+
+func (a *LocalArchiver) Get(name string) (io.ReadCloser, error) {
+	return os.Open(path.Join(a.Dir, name))
+}
+
+func (a *LocalArchiver) Delete(name string) error {
+	err := os.Remove(path.Join(a.Dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// prefixArchiver stores files under a prefix in another archiver.
+type prefixArchiver struct {
+	archiver SegmentArchiver
+	prefix   string
+}
+
+func (a *prefixArchiver) Put(name string, r io.Reader) error {
+	return a.archiver.Put(a.prefix+name, r)
+}
+
+func (a *prefixArchiver) Get(name string) (io.ReadCloser, error) {
+	return a.archiver.Get(a.prefix + name)
+}
+
+func (a *prefixArchiver) Delete(name string) error {
+	return a.archiver.Delete(a.prefix + name)
+}
+
+// archiveMarker holds what the log needs to know about an archived
+// segment without fetching it.
+type archiveMarker struct {
+	NextOffset   uint64
+	MaxTimestamp int64
+	Size         uint64
+	ModTime      time.Time
+
+	// path is where the marker is stored in the log's directory.
+	path string
+}
+
+// Archive moves the closed segments whose stores haven't been written to
+// for Archive.After to the archiver. Their files are uploaded, then
+// replaced with a small marker in the log's directory. Archived segments
+// are still part of the log: reading them fetches them back into a cache,
+// and retention still removes them, from the archiver too. Compaction
+// and key rotation leave them alone. The log is only locked to pick the
+// segments and to swap each one's files for its marker, not while they're
+// uploaded.
+func (l *Log) Archive() error {
+	if l.Config.Archive.Archiver == nil {
+		return nil
+	}
+
+	l.rewriteMu.Lock()
+	defer l.rewriteMu.Unlock()
+
+	segments, modTimes, err := l.archivable()
+	if err != nil {
+		return err
+	}
+	for i, s := range segments {
+		if err = l.archive(s, modTimes[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// archivable returns the closed segments that are due to be archived,
+// and when their stores were last written to.
+func (l *Log) archivable() ([]*segment, []time.Time, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	var (
+		segments []*segment
+		modTimes []time.Time
+	)
+	for _, s := range l.segments[:len(l.segments)-1] {
+		if s.archive != nil {
+			continue
+		}
+		modTime, err := s.modTime()
+		if err != nil {
+			return nil, nil, err
+		}
+		if time.Since(modTime) < l.Config.Archive.After {
+			continue
+		}
+		segments = append(segments, s)
+		modTimes = append(modTimes, modTime)
+	}
+
+	return segments, modTimes, nil
+}
+
+// archive moves the segment to the archiver. Its files are uploaded as
+// they were when it was picked, which is all there is to them since it's
+// closed. The marker is only written once every file is archived, and the
+// files only removed once the marker is written, so a segment is never
+// lost if the process dies part way through.
+func (l *Log) archive(s *segment, modTime time.Time) error {
+	l.mu.RLock()
+	_, files, err := l.pinSegment(s)
+	l.mu.RUnlock()
+	if err == os.ErrClosed {
+		// Retention removed the segment since it was picked.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer closePinned(files)
+
+	archiver := l.Config.Archive.Archiver
+	for _, f := range files {
+		name := path.Base(f.Name())
+		if err = archiver.Put(name, io.LimitReader(f, int64(f.size))); err != nil {
+			return err
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if s.closed {
+		// Retention removed the segment during the upload, so the
+		// archiver shouldn't keep its files either.
+		for _, f := range files {
+			if err = archiver.Delete(path.Base(f.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Closing the files truncates the indexes to their entries, which is
+	// as much of them as was uploaded.
+	l.forget(s)
+	if err = s.closeFiles(); err != nil {
+		return err
+	}
+
+	m := &archiveMarker{
+		NextOffset:   s.nextOffset,
+		MaxTimestamp: s.maxTimestamp,
+		Size:         s.closedSize,
+		ModTime:      modTime,
+		path:         s.path(archivedExt),
+	}
+	if err = m.write(); err != nil {
+		return err
+	}
+	if err = s.removeFiles(); err != nil {
+		return err
+	}
+
+	s.archive = m
+	s.dir = path.Join(l.Dir, cacheDir)
+	return nil
+}
+
+// fetch downloads the archived segment's files into the cache.
+func (s *segment) fetch() error {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+
+	for _, ext := range []string{".store", ".index", ".timeindex"} {
+		if err := s.get(ext); err != nil {
+			s.removeFiles()
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *segment) get(ext string) error {
+	r, err := s.config.Archive.Archiver.Get(s.name(ext))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	f, err := os.Create(s.path(ext))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, r)
+	return err
+}
+
+// removeArchived deletes the archived segment's files from the archiver,
+// then its marker.
+func (s *segment) removeArchived() error {
+	for _, ext := range []string{".store", ".index", ".timeindex"} {
+		if err := s.config.Archive.Archiver.Delete(s.name(ext)); err != nil {
+			return err
+		}
+	}
+
+	return os.Remove(s.archive.path)
+}
+
+// loadArchivedSegment returns the archived segment with the given base
+// offset in dir, as described by its marker. Files left behind in dir by
+// an archive that was cut short are removed; the archiver has them.
+func loadArchivedSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
+	s := &segment{
+		dir:        dir,
+		baseOffset: baseOffset,
+		config:     c,
+		// Archived segments are left out of key rotation, so there's no
+		// need to know their keys.
+		keys: newKeySet(),
+	}
+
+	m, err := readArchiveMarker(s.path(archivedExt))
+	if err != nil {
+		return nil, err
+	}
+	if err = s.removeFiles(); err != nil {
+		return nil, err
+	}
+
+	s.archive = m
+	s.dir = path.Join(dir, cacheDir)
+	s.nextOffset = m.NextOffset
+	s.maxTimestamp = m.MaxTimestamp
+	s.closedSize = m.Size
+	return s, nil
+}
+
+// readArchiveMarker reads the marker stored at path.
+func readArchiveMarker(path string) (*archiveMarker, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &archiveMarker{path: path}
+	return m, json.Unmarshal(b, m)
+}
+
+// write stores the marker, replacing it as a whole.
+func (m *archiveMarker) write() error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	tmp := m.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err = f.Write(b); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, m.path)
+}
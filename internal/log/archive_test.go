@@ -0,0 +1,303 @@
+package log
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	api "github.com/hindenbug/dlog/api/log/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	logDir, archiveDir := path.Join(dir, "log"), path.Join(dir, "archive")
+	require.NoError(t, os.Mkdir(logDir, 0755))
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 100
+	c.Segment.MaxOpenSegments = 2
+	c.Archive.Archiver = &LocalArchiver{Dir: archiveDir}
+	log, err := NewLog(logDir, c)
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(log.segments), 2)
+	require.NoError(t, log.Archive())
+
+	// Every closed segment is replaced with a marker.
+	archived := log.segments[:len(log.segments)-1]
+	for _, s := range archived {
+		require.NotNil(t, s.archive)
+		_, err := os.Stat(path.Join(logDir, s.name(archivedExt)))
+		require.NoError(t, err)
+		_, err = os.Stat(path.Join(logDir, s.name(".store")))
+		require.True(t, os.IsNotExist(err))
+		_, err = os.Stat(path.Join(archiveDir, s.name(".store")))
+		require.NoError(t, err)
+	}
+
+	check := func(log *Log) {
+		for off := uint64(0); off < 10; off++ {
+			read, err := log.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, off, read.Offset)
+		}
+		// Only the segments that are still open are in the cache.
+		files, err := ioutil.ReadDir(path.Join(logDir, cacheDir))
+		require.NoError(t, err)
+		require.LessOrEqual(t, len(files), 3*int(c.Segment.MaxOpenSegments))
+	}
+	check(log)
+	require.NoError(t, log.Close())
+
+	// Archived segments stay archived across restarts.
+	log, err = NewLog(logDir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	for i, s := range archived {
+		require.NotNil(t, log.segments[i].archive)
+		require.Equal(t, s.nextOffset, log.segments[i].nextOffset)
+	}
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(9), highest)
+	check(log)
+
+	// Retention removes archived segments from the archiver too.
+	log.Config.Retention.MaxRecords = 1
+	require.NoError(t, log.Clean())
+	require.Equal(t, 1, len(log.segments))
+	files, err := ioutil.ReadDir(archiveDir)
+	require.NoError(t, err)
+	require.Empty(t, files)
+}
+
+// blockingArchiver holds up every Get until release is closed.
+type blockingArchiver struct {
+	*LocalArchiver
+	fetching chan struct{}
+	release  chan struct{}
+}
+
+func (a *blockingArchiver) Get(name string) (io.ReadCloser, error) {
+	select {
+	case a.fetching <- struct{}{}:
+	default:
+	}
+	<-a.release
+	return a.LocalArchiver.Get(name)
+}
+
+func TestArchiveFetch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-fetch-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	logDir, archiveDir := path.Join(dir, "log"), path.Join(dir, "archive")
+	require.NoError(t, os.Mkdir(logDir, 0755))
+
+	archiver := &blockingArchiver{
+		LocalArchiver: &LocalArchiver{Dir: archiveDir},
+		fetching:      make(chan struct{}, 1),
+		release:       make(chan struct{}),
+	}
+	c := Config{}
+	c.Segment.MaxStoreBytes = 100
+	c.Archive.Archiver = archiver
+	log, err := NewLog(logDir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	for i := 0; i < 10; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Archive())
+
+	// Two readers of an archived segment share a single fetch.
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := log.Read(0)
+			errs <- err
+		}()
+	}
+	<-archiver.fetching
+
+	// Segments that don't need fetching can be read meanwhile, and
+	// appends don't wait either.
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	read, err := log.Read(highest)
+	require.NoError(t, err)
+	require.Equal(t, highest, read.Offset)
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	close(archiver.release)
+	for i := 0; i < 2; i++ {
+		require.NoError(t, <-errs)
+	}
+}
+
+// blockingPutArchiver holds up every Put until release is closed.
+type blockingPutArchiver struct {
+	*LocalArchiver
+	putting chan struct{}
+	release chan struct{}
+}
+
+func (a *blockingPutArchiver) Put(name string, r io.Reader) error {
+	select {
+	case a.putting <- struct{}{}:
+	default:
+	}
+	<-a.release
+	return a.LocalArchiver.Put(name, r)
+}
+
+func TestArchiveUpload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-upload-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	logDir, archiveDir := path.Join(dir, "log"), path.Join(dir, "archive")
+	require.NoError(t, os.Mkdir(logDir, 0755))
+
+	archiver := &blockingPutArchiver{
+		LocalArchiver: &LocalArchiver{Dir: archiveDir},
+		putting:       make(chan struct{}, 1),
+		release:       make(chan struct{}),
+	}
+	c := Config{}
+	c.Segment.MaxStoreBytes = 100
+	c.Archive.Archiver = archiver
+	log, err := NewLog(logDir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	for i := 0; i < 10; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	errc := make(chan error)
+	go func() {
+		errc <- log.Archive()
+	}()
+	<-archiver.putting
+
+	// Segments being uploaded can still be read, and appends carry on.
+	read, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), read.Offset)
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), off)
+
+	close(archiver.release)
+	require.NoError(t, <-errc)
+	require.NotNil(t, log.segments[0].archive)
+	for off := uint64(0); off <= 10; off++ {
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, read.Offset)
+	}
+}
+
+func TestArchiveCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-compaction-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	logDir, archiveDir := path.Join(dir, "log"), path.Join(dir, "archive")
+	require.NoError(t, os.Mkdir(logDir, 0755))
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = uint64(entryWidth) * 2
+	c.Compaction.Enabled = true
+	c.Compaction.TombstoneRetention = time.Hour
+	c.Archive.Archiver = &LocalArchiver{Dir: archiveDir}
+	log, err := NewLog(logDir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	old := time.Now().Add(-2 * time.Hour).UnixMilli()
+	appendAll := func(records ...*api.Record) {
+		for _, record := range records {
+			_, err := log.Append(record)
+			require.NoError(t, err)
+		}
+	}
+	appendAll(
+		// segment 0, archived
+		&api.Record{Key: []byte("a"), Value: []byte("a1")},
+		&api.Record{Value: []byte("no key")},
+		// segment 2
+		&api.Record{Value: []byte("no key")},
+	)
+	require.NoError(t, log.Archive())
+	require.NotNil(t, log.segments[0].archive)
+	appendAll(
+		&api.Record{Key: []byte("a"), Timestamp: old},
+		// segment 4
+		&api.Record{Value: []byte("no key")},
+	)
+	require.NoError(t, log.Compact())
+
+	// The tombstone for a has expired, but a1 is still in an archived
+	// segment, so it's kept.
+	record, err := log.Read(3)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), record.Offset)
+	require.Equal(t, []byte("a"), record.Key)
+	require.Empty(t, record.Value)
+}
+
+func TestArchiveEmptySegment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-empty-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	logDir, archiveDir := path.Join(dir, "log"), path.Join(dir, "archive")
+	require.NoError(t, os.Mkdir(logDir, 0755))
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = uint64(entryWidth) * 2
+	c.Compaction.Enabled = true
+	c.Archive.Archiver = &LocalArchiver{Dir: archiveDir}
+	log, err := NewLog(logDir, c)
+	require.NoError(t, err)
+
+	for _, value := range []string{"a1", "a2", "a3", "a4", "a5"} {
+		_, err := log.Append(&api.Record{Key: []byte("a"), Value: []byte(value)})
+		require.NoError(t, err)
+	}
+
+	// Compaction leaves the closed segments empty before they're archived.
+	require.NoError(t, log.Compact())
+	require.NoError(t, log.Archive())
+	require.NotNil(t, log.segments[0].archive)
+	require.NoError(t, log.Close())
+
+	log, err = NewLog(logDir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	record, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), record.Offset)
+	require.Equal(t, []byte("a5"), record.Value)
+}
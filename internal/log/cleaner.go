@@ -0,0 +1,113 @@
+package log
+
+import (
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const defaultCleanInterval = 5 * time.Minute
+
+// Cleaner applies a log's retention policies in the background, calling
+// Log.Clean every Interval until it's closed. If the log has compaction,
+// encryption or archiving enabled, it calls Log.Compact, Log.RotateKeys or
+// Log.Archive too.
+type Cleaner struct {
+	Log      *Log
+	Interval time.Duration
+
+	logger *zap.Logger
+
+	mu      sync.Mutex
+	running bool
+	closed  bool
+	close   chan struct{}
+	// done is closed when the goroutine started by Start returns.
+	done chan struct{}
+}
+
+func (c *Cleaner) Start() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+
+	if c.closed || c.running {
+		return
+	}
+	c.running = true
+	c.done = make(chan struct{})
+
+	go c.run()
+}
+
+func (c *Cleaner) run() {
+	defer close(c.done)
+
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.close:
+			return
+		case <-ticker.C:
+			c.try("clean", c.Log.Clean)
+			if c.Log.Config.Compaction.Enabled {
+				c.try("compact", c.Log.Compact)
+			}
+			if c.Log.Config.Encryption.Keyring != nil {
+				c.try("rotate keys of", c.Log.RotateKeys)
+			}
+			if c.Log.Config.Archive.Archiver != nil {
+				c.try("archive", c.Log.Archive)
+			}
+		}
+	}
+}
+
+// try runs fn and logs its error, if any, as a failure to do action to
+// the log.
+func (c *Cleaner) try(action string, fn func() error) {
+	if err := fn(); err != nil {
+		c.logger.Error(
+			"failed to "+action+" log",
+			zap.String("dir", c.Log.Dir),
+			zap.Error(err),
+		)
+	}
+}
+
+func (c *Cleaner) init() {
+	if c.logger == nil {
+		c.logger = zap.L().Named("cleaner")
+	}
+	if c.Interval == 0 {
+		c.Interval = defaultCleanInterval
+	}
+	if c.close == nil {
+		c.close = make(chan struct{})
+	}
+}
+
+// Close stops the cleaner, waiting for a run that's under way to finish,
+// so the log can be closed or removed safely once it returns.
+func (c *Cleaner) Close() error {
+	c.mu.Lock()
+	c.init()
+
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.close)
+	done := c.done
+	c.mu.Unlock()
+
+	if done != nil {
+		<-done
+	}
+
+	return nil
+}
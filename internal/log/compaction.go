@@ -0,0 +1,237 @@
+package log
+
+import (
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	api "github.com/hindenbug/dlog/api/log/v1"
+)
+
+// rewriteDir is where compacted or re-encrypted segments are written
+// before they replace the originals.
+const rewriteDir = "rewrite"
+
+// Compact rewrites the log's closed segments so each key keeps only its
+// latest record. Tombstones, records with a key and an empty value, are
+// dropped along with the records they delete once they're older than
+// Compaction.TombstoneRetention. Records without a key are always kept.
+//
+// Offsets never change: a compacted segment keeps the offsets of the
+// records it still holds, and reading a removed offset returns the next
+// record in the log. A segment's next offset is its successor's base
+// offset, so it survives a restart even if its last records were removed.
+// Archived segments aren't compacted, so a tombstone is kept for as long
+// as an archived segment before it might hold a record it deletes.
+//
+// The log is read for compaction while appends and reads carry on. It's
+// only locked to swap each rewritten segment in.
+func (l *Log) Compact() error {
+	l.rewriteMu.Lock()
+	defer l.rewriteMu.Unlock()
+
+	segments, end, archived := l.closedSegments()
+	if len(segments) == 0 {
+		return nil
+	}
+
+	// A single pass finds each key's latest record, and which segments
+	// hold records that compaction removes: ones a later record with the
+	// same key supersedes, and expired tombstones.
+	deleteBefore := time.Now().Add(-l.Config.Compaction.TombstoneRetention).UnixMilli()
+	expired := func(record *api.Record) bool {
+		return len(record.Value) == 0 && record.Timestamp < deleteBefore &&
+			record.Offset < archived
+	}
+	latest := make(map[string]uint64)
+	dirty := make(map[*segment]bool)
+	mark := func(offset uint64) {
+		i := sort.Search(len(segments), func(i int) bool {
+			return offset < segments[i].next
+		})
+		if i < len(segments) && offset >= segments[i].baseOffset {
+			dirty[segments[i].segment] = true
+		}
+	}
+	err := l.each(segments[0].baseOffset, end, func(record *api.Record) error {
+		if record.Key == nil {
+			return nil
+		}
+		if prev, ok := latest[string(record.Key)]; ok {
+			mark(prev)
+		}
+		latest[string(record.Key)] = record.Offset
+		if expired(record) {
+			mark(record.Offset)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	tmp, err := l.rewriteDir()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	for _, s := range segments {
+		if !dirty[s.segment] {
+			continue
+		}
+		err := l.rewrite(s, tmp, func(record *api.Record) bool {
+			if record.Key == nil {
+				return true
+			}
+			if latest[string(record.Key)] != record.Offset {
+				return false
+			}
+			return !expired(record)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// closedSegment is a closed segment along with its next offset when it was
+// picked for a rewrite, which is safe to use without holding l.mu.
+type closedSegment struct {
+	*segment
+	next uint64
+}
+
+// closedSegments returns the log's closed segments that aren't archived,
+// the offset the next appended record will get, and the base offset of
+// the first archived segment, or that next offset if none is archived.
+func (l *Log) closedSegments() (segments []closedSegment, end, archived uint64) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	end = l.activeSegment.nextOffset
+	archived = end
+	for _, s := range l.segments[:len(l.segments)-1] {
+		if s.archive == nil {
+			segments = append(segments, closedSegment{s, s.nextOffset})
+		} else if s.baseOffset < archived {
+			archived = s.baseOffset
+		}
+	}
+
+	return segments, end, archived
+}
+
+// each calls fn with the log's records from offset from up to, but not
+// including, offset to. They're read with an iterator, so appends and
+// reads carry on meanwhile.
+func (l *Log) each(from, to uint64, fn func(*api.Record) error) error {
+	it := l.Iterator(from)
+	defer it.Close()
+
+	for it.Next() {
+		record := it.Record()
+		if record.Offset >= to {
+			return nil
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+
+	return it.Err()
+}
+
+// rewriteDir creates an empty directory to write new segments into.
+func (l *Log) rewriteDir() (string, error) {
+	tmp := path.Join(l.Dir, rewriteDir)
+	if err := os.RemoveAll(tmp); err != nil {
+		return "", err
+	}
+
+	return tmp, os.Mkdir(tmp, 0755)
+}
+
+// rewrite writes the records of the closed segment that keep selects, with
+// their offsets and timestamps unchanged, to a new segment in tmp, and then
+// swaps it in for the old one. Only the swap happens under the lock. If the
+// segment was removed or archived in the meantime, the new one is dropped.
+func (l *Log) rewrite(old closedSegment, tmp string, keep func(*api.Record) bool) error {
+	s, err := newSegment(tmp, old.baseOffset, l.Config)
+	if err != nil {
+		return err
+	}
+	err = l.each(old.baseOffset, old.next, func(record *api.Record) error {
+		if !keep(record) {
+			return nil
+		}
+		s.nextOffset = record.Offset
+		_, err := s.Append(record)
+		return err
+	})
+	if cerr := s.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	i := sort.Search(len(l.segments), func(i int) bool {
+		return l.segments[i].baseOffset >= old.baseOffset
+	})
+	if i == len(l.segments) || l.segments[i] != old.segment || old.archive != nil {
+		return nil
+	}
+
+	s, err = l.swap(old.segment, s)
+	if err != nil {
+		return err
+	}
+	l.segments[i] = s
+
+	return nil
+}
+
+// swap moves the files of the rewritten segment s over the old segment's
+// and opens them. The old index files are removed first: if the process
+// dies part way through, the segment is left with a store and no index,
+// which is rebuilt when the log is opened. If the swap fails, the old
+// segment stays usable and is reopened from whatever files it then has.
+// It must be called with l.mu held.
+func (l *Log) swap(old, s *segment) (*segment, error) {
+	keys := s.keys
+	l.forget(old)
+	if err := old.closeFiles(); err != nil {
+		return nil, err
+	}
+	for _, ext := range []string{".index", ".timeindex"} {
+		if err := os.Remove(old.path(ext)); err != nil {
+			return nil, err
+		}
+	}
+	for _, ext := range []string{".store", ".index", ".timeindex"} {
+		if err := os.Rename(s.path(ext), old.path(ext)); err != nil {
+			return nil, err
+		}
+	}
+
+	s, err := newSegment(l.Dir, old.baseOffset, l.Config)
+	if err != nil {
+		return nil, err
+	}
+	// The rewrite may have dropped the segment's last records.
+	s.nextOffset = old.nextOffset
+	s.keys.merge(keys)
+	l.track(s)
+
+	// Iterators still reading the old segment look it up again.
+	old.closed = true
+
+	return s, nil
+}
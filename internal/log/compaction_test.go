@@ -0,0 +1,100 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	api "github.com/hindenbug/dlog/api/log/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compaction-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = uint64(entryWidth) * 4
+	c.Compaction.Enabled = true
+	c.Compaction.TombstoneRetention = time.Hour
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	old := time.Now().Add(-2 * time.Hour).UnixMilli()
+	records := []*api.Record{
+		// segment 0
+		{Key: []byte("a"), Value: []byte("a1")},
+		{Key: []byte("b"), Value: []byte("b1")},
+		{Value: []byte("no key")},
+		{Key: []byte("a"), Value: []byte("a2")},
+		// segment 4
+		{Key: []byte("c"), Value: []byte("c1"), Timestamp: old},
+		{Key: []byte("c"), Timestamp: old},
+		{Key: []byte("b"), Value: []byte("b2")},
+		{Key: []byte("a"), Value: []byte("a3")},
+		// segment 8
+		{Key: []byte("b")},
+		{Key: []byte("d"), Value: []byte("d1")},
+	}
+	for _, record := range records {
+		_, err := log.Append(record)
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Compact())
+
+	read := func(log *Log) []uint64 {
+		var offsets []uint64
+		for off := uint64(0); off < 10; {
+			record, err := log.Read(off)
+			require.NoError(t, err)
+			offsets = append(offsets, record.Offset)
+			off = record.Offset + 1
+		}
+		return offsets
+	}
+
+	// a1, a2, b1 and b2 are superseded and the expired tombstone for c
+	// removes both c records. The tombstone for b is in the active
+	// segment, so it stays.
+	want := []uint64{2, 7, 8, 9}
+	require.Equal(t, want, read(log))
+
+	iterate := func(log *Log) []uint64 {
+		var offsets []uint64
+		it := log.Iterator(0)
+		defer it.Close()
+		for it.Next() {
+			offsets = append(offsets, it.Record().Offset)
+		}
+		require.NoError(t, it.Err())
+		return offsets
+	}
+	require.Equal(t, want, iterate(log))
+
+	// Segment 0 lost its last record, so reading it carries on into the
+	// next segment.
+	record, err := log.Read(3)
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), record.Offset)
+
+	record, err = log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), record.Offset)
+	require.Equal(t, []byte("no key"), record.Value)
+
+	// Compacted segments survive a restart with their offsets intact.
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, want, read(log))
+	require.Equal(t, want, iterate(log))
+
+	off, err := log.Append(&api.Record{Value: []byte("next")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), off)
+
+	_, err = os.Stat(dir + "/" + rewriteDir)
+	require.True(t, os.IsNotExist(err))
+}
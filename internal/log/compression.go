@@ -0,0 +1,72 @@
+package log
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec is the compression applied to a record's payload in the store.
+type Codec byte
+
+const (
+	NoCompression Codec = iota
+	Gzip
+	Snappy
+	Zstd
+)
+
+// codecMask picks the codec out of a record's attributes byte.
+const codecMask = 0x07
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+func (c Codec) compress(p []byte) ([]byte, error) {
+	switch c {
+	case NoCompression:
+		return p, nil
+	case Gzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(p); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case Snappy:
+		return snappy.Encode(nil, p), nil
+	case Zstd:
+		return zstdEncoder.EncodeAll(p, nil), nil
+	default:
+		return nil, fmt.Errorf("unknown compression codec: %d", c)
+	}
+}
+
+func (c Codec) decompress(p []byte) ([]byte, error) {
+	switch c {
+	case NoCompression:
+		return p, nil
+	case Gzip:
+		r, err := gzip.NewReader(bytes.NewReader(p))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	case Snappy:
+		return snappy.Decode(nil, p)
+	case Zstd:
+		return zstdDecoder.DecodeAll(p, nil)
+	default:
+		return nil, fmt.Errorf("unknown compression codec: %d", c)
+	}
+}
@@ -0,0 +1,48 @@
+package log
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api "github.com/hindenbug/dlog/api/log/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compression-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	value := bytes.Repeat([]byte(`{"hello":"world"}`), 64)
+
+	// Each codec writes a record, and the records are read back once the
+	// log is reopened with a different codec.
+	c := Config{}
+	codecs := []Codec{NoCompression, Gzip, Snappy, Zstd}
+	for _, codec := range codecs {
+		c.Compression = codec
+		log, err := NewLog(dir, c)
+		require.NoError(t, err)
+
+		before := log.activeSegment.store.size
+		_, err = log.Append(&api.Record{Value: value})
+		require.NoError(t, err)
+		if codec != NoCompression {
+			require.Less(t, log.activeSegment.store.size-before, uint64(len(value)))
+		}
+		require.NoError(t, log.Close())
+	}
+
+	c.Compression = NoCompression
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	for off := range codecs {
+		read, err := log.Read(uint64(off))
+		require.NoError(t, err)
+		require.Equal(t, value, read.Value)
+	}
+}
@@ -1,9 +1,96 @@
 package log
 
+import "time"
+
 type Config struct {
 	Segment struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
 		InitialOffset uint64
+		// MaxOpenSegments caps how many segments keep their files open.
+		// Each open segment holds three file descriptors and two mmaps of
+		// MaxIndexBytes. The least recently used ones are closed, and
+		// reopened when they're read again. Zero means no limit. Only the
+		// active segment is opened when the log starts.
+		MaxOpenSegments uint64
+		// IndexIntervalBytes makes the index sparse: an entry is only
+		// written once this many bytes were written to the store since
+		// the last one, and reads scan forward from the closest entry.
+		// Zero indexes every record.
+		IndexIntervalBytes uint64
+	}
+	// Compression is the codec new records are compressed with. Every
+	// record's header names its codec, so records written with different
+	// codecs can be read side by side.
+	Compression Codec
+	// Encryption, when Keyring is set, encrypts records before they're
+	// written to the store. See Keyring for how keys are rotated. The
+	// keyring is left out of snapshot manifests; a restored log needs it
+	// set again.
+	Encryption struct {
+		Keyring *Keyring `json:"-"`
+	}
+	// Retention limits how much data the log keeps. Whole segments are
+	// dropped, oldest first, once any of the non-zero limits is exceeded.
+	// The active segment is never removed.
+	Retention struct {
+		MaxBytes   uint64
+		MaxAge     time.Duration
+		MaxRecords uint64
+	}
+	// Compaction, when enabled, keeps only the latest record for each key
+	// in the log's closed segments. Records with a key and an empty value
+	// are tombstones: they mark the key as deleted and are themselves
+	// removed once they're older than TombstoneRetention.
+	Compaction struct {
+		Enabled            bool
+		TombstoneRetention time.Duration
+	}
+	// Archive, when Archiver is set, moves closed segments whose stores
+	// haven't been written to for After to cheaper storage. Reading an
+	// archived segment fetches it back into a cache in the log's
+	// directory, where it stays until its files are closed again, so
+	// MaxOpenSegments bounds the cache too.
+	Archive struct {
+		Archiver SegmentArchiver `json:"-"`
+		After    time.Duration
+	}
+	// Durability decides when appended records are fsynced to disk.
+	// Log.Append returns only once the policy's guarantee holds.
+	Durability struct {
+		Policy SyncPolicy
+		// With SyncPeriodic, the log is fsynced once Records records are
+		// waiting or Interval has passed since the last sync, whichever
+		// comes first. Either can be left at zero to disable it.
+		Records  uint64
+		Interval time.Duration
 	}
 }
+
+// withDefaults returns c with defaults filled in for the segment limits
+// left at zero.
+func (c Config) withDefaults() Config {
+	if c.Segment.MaxStoreBytes == 0 {
+		c.Segment.MaxStoreBytes = 1024
+	}
+	if c.Segment.MaxIndexBytes == 0 {
+		c.Segment.MaxIndexBytes = 1024
+	}
+
+	return c
+}
+
+// SyncPolicy is how eagerly a log fsyncs the records appended to it.
+type SyncPolicy int
+
+const (
+	// SyncOS hands every record to the operating system before Append
+	// returns, so it survives the process crashing, and leaves it to the
+	// OS to decide when to write it to disk.
+	SyncOS SyncPolicy = iota
+	// SyncAlways fsyncs every record before Append returns.
+	SyncAlways
+	// SyncPeriodic fsyncs records in groups, as set by the Records and
+	// Interval durability options.
+	SyncPeriodic
+)
@@ -0,0 +1,327 @@
+package log
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	api "github.com/hindenbug/dlog/api/log/v1"
+)
+
+// Encrypted payloads are laid out as:
+//
+//	key id (4) | nonce (12) | AES-GCM ciphertext and tag
+var (
+	keyIDWidth = 4
+	nonceWidth = 12
+)
+
+var errNoKeyring = errors.New("record is encrypted but no keyring is configured")
+
+// Keyring holds the AES keys used to encrypt records at rest. Keys are
+// loaded from a keyfile with one key per line: a numeric key ID followed by
+// the hex encoded 16, 24 or 32 byte key. Blank lines and lines starting
+// with # are ignored.
+//
+// The last key in the file is the active one, used for every new record.
+// The others are only used to read records written with them. To rotate,
+// append a new key to the file; Log.RotateKeys picks it up and re-encrypts
+// the closed segments with it. An old key can be removed once the
+// segments that were active when it was replaced have been closed and
+// rotated too.
+type Keyring struct {
+	path string
+
+	mu     sync.RWMutex
+	keys   map[uint32]cipher.AEAD
+	active uint32
+}
+
+// LoadKeyring loads the keys from the keyfile at path.
+func LoadKeyring(path string) (*Keyring, error) {
+	k := &Keyring{path: path}
+
+	return k, k.Reload()
+}
+
+// Reload reads the keyfile again, so keys added or removed since it was
+// loaded take effect.
+func (k *Keyring) Reload() error {
+	f, err := os.Open(k.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	keys := make(map[uint32]cipher.AEAD)
+	var active uint32
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("malformed keyfile line: %q", line)
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return err
+		}
+		secret, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return err
+		}
+		block, err := aes.NewCipher(secret)
+		if err != nil {
+			return err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return err
+		}
+
+		keys[uint32(id)] = aead
+		active = uint32(id)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no keys in keyfile: %s", k.path)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys, k.active = keys, active
+
+	return nil
+}
+
+// Active returns the ID of the key new records are encrypted with.
+func (k *Keyring) Active() uint32 {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.active
+}
+
+// seal encrypts p with the active key.
+func (k *Keyring) seal(p []byte) ([]byte, error) {
+	k.mu.RLock()
+	id, aead := k.active, k.keys[k.active]
+	k.mu.RUnlock()
+
+	b := make([]byte, keyIDWidth+nonceWidth, keyIDWidth+nonceWidth+len(p)+aead.Overhead())
+	binary.BigEndian.PutUint32(b[:keyIDWidth], id)
+	nonce := b[keyIDWidth:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(b, nonce, p, nil), nil
+}
+
+// open decrypts a payload sealed with any of the keyring's keys.
+func (k *Keyring) open(p []byte) ([]byte, error) {
+	if len(p) < keyIDWidth+nonceWidth {
+		return nil, errors.New("encrypted payload is too short")
+	}
+
+	id := keyID(p)
+	k.mu.RLock()
+	aead, ok := k.keys[id]
+	k.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption key: %d", id)
+	}
+
+	nonce := p[keyIDWidth : keyIDWidth+nonceWidth]
+	return aead.Open(nil, nonce, p[keyIDWidth+nonceWidth:], nil)
+}
+
+// keyID returns the ID of the key an encrypted payload was sealed with.
+func keyID(p []byte) uint32 {
+	return binary.BigEndian.Uint32(p[:keyIDWidth])
+}
+
+// RotateKeys reloads the keyring and re-encrypts every closed segment that
+// holds records which aren't encrypted with the active key. Records in the
+// active segment are re-encrypted once it's closed and RotateKeys runs
+// again. Archived segments keep the keys they were archived with.
+func (l *Log) RotateKeys() error {
+	keyring := l.Config.Encryption.Keyring
+	if keyring == nil {
+		return nil
+	}
+	if err := keyring.Reload(); err != nil {
+		return err
+	}
+
+	l.rewriteMu.Lock()
+	defer l.rewriteMu.Unlock()
+
+	segments, _, _ := l.closedSegments()
+	if len(segments) == 0 {
+		return nil
+	}
+
+	tmp, err := l.rewriteDir()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	active := keyring.Active()
+	for _, s := range segments {
+		stale, known := s.keys.stale(active)
+		if !known {
+			if err := l.scanKeys(s.segment); err != nil {
+				return err
+			}
+			stale, _ = s.keys.stale(active)
+		}
+		if !stale {
+			continue
+		}
+
+		err = l.rewrite(s, tmp, func(*api.Record) bool { return true })
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// scanKeys reads the keys the segment's records are encrypted with from
+// its store. Segments appended to since the log was opened already know
+// them, so a segment is only scanned once. The store is read through its
+// own file, without holding the log's lock.
+func (l *Log) scanKeys(s *segment) error {
+	size, err := l.flush(s)
+	if err == os.ErrClosed {
+		// The segment was removed since it was picked.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(s.path(".store"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	keys := newKeySet()
+	r := bufio.NewReader(io.LimitReader(f, int64(size)))
+	for pos := uint64(0); pos < size; {
+		p, attributes, err := readRecord(r, pos, size)
+		if err != nil {
+			return err
+		}
+		keys.add(p, attributes)
+		pos += headerWidth + uint64(len(p))
+	}
+	s.keys.merge(keys)
+
+	return nil
+}
+
+// flush writes out the segment's buffered records and returns the size of
+// its store.
+func (l *Log) flush(s *segment) (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if err := l.acquire(s); err != nil {
+		return 0, err
+	}
+	defer l.release(s)
+
+	if err := s.store.Flush(); err != nil {
+		return 0, err
+	}
+
+	return s.store.size, nil
+}
+
+// keySet records which keys a segment's records are encrypted with, so
+// RotateKeys can tell whether the segment needs re-encrypting without
+// reading it.
+type keySet struct {
+	mu sync.Mutex
+	// known is set once the set covers every record in the segment. A
+	// segment opened with records in it has to be scanned first.
+	known     bool
+	plaintext bool
+	ids       map[uint32]bool
+}
+
+func newKeySet() *keySet {
+	return &keySet{known: true, ids: make(map[uint32]bool)}
+}
+
+// add records the key of a payload written to the store with the given
+// attributes.
+func (k *keySet) add(p []byte, attributes byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if attributes&encryptedFlag == 0 {
+		k.plaintext = true
+	} else {
+		k.ids[keyID(p)] = true
+	}
+}
+
+// merge adds the keys in o to the set, which then covers the segment.
+func (k *keySet) merge(o *keySet) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.known = true
+	k.plaintext = k.plaintext || o.plaintext
+	for id := range o.ids {
+		k.ids[id] = true
+	}
+}
+
+// stale reports whether any of the segment's records isn't encrypted with
+// the active key, and whether the set knows.
+func (k *keySet) stale(active uint32) (stale, known bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if !k.known {
+		return false, false
+	}
+	if k.plaintext {
+		return true, true
+	}
+	for id := range k.ids {
+		if id != active {
+			return true, true
+		}
+	}
+
+	return false, true
+}
@@ -0,0 +1,102 @@
+package log
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	api "github.com/hindenbug/dlog/api/log/v1"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testKey1 = "000102030405060708090a0b0c0d0e0f000102030405060708090a0b0c0d0e0f"
+	testKey2 = "0f0e0d0c0b0a09080706050403020100"
+)
+
+func TestEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "encryption-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	keyfile := path.Join(dir, "keys")
+	writeKeys := func(lines string) {
+		require.NoError(t, ioutil.WriteFile(keyfile, []byte(lines), 0600))
+	}
+	writeKeys("# test keys\n1 " + testKey1 + "\n")
+
+	keyring, err := LoadKeyring(keyfile)
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), keyring.Active())
+
+	logDir := path.Join(dir, "log")
+	require.NoError(t, os.Mkdir(logDir, 0755))
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	c.Encryption.Keyring = keyring
+	log, err := NewLog(logDir, c)
+	require.NoError(t, err)
+
+	value := []byte("top secret")
+	for i := 0; i < 3; i++ {
+		_, err = log.Append(&api.Record{Value: value})
+		require.NoError(t, err)
+	}
+
+	// Neither the files nor the raw reader give the value away.
+	raw, err := ioutil.ReadAll(log.Reader())
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(raw, value))
+
+	for off := uint64(0); off < 3; off++ {
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, value, read.Value)
+	}
+
+	// Segments keep track of the keys their records are written with.
+	stale, known := log.segments[0].keys.stale(1)
+	require.True(t, known)
+	require.False(t, stale)
+
+	// Rotating to a new key re-encrypts the closed segments, after which
+	// the old key can be retired.
+	writeKeys("1 " + testKey1 + "\n2 " + testKey2 + "\n")
+	require.NoError(t, log.RotateKeys())
+	stale, known = log.segments[0].keys.stale(2)
+	require.True(t, known)
+	require.False(t, stale)
+	require.Equal(t, uint32(2), keyring.Active())
+	_, err = log.Append(&api.Record{Value: value})
+	require.NoError(t, err)
+	require.NoError(t, log.RotateKeys())
+	require.NoError(t, log.Close())
+
+	writeKeys("2 " + testKey2 + "\n")
+	require.NoError(t, keyring.Reload())
+	log, err = NewLog(logDir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	// Segments loaded from disk are scanned for their keys once.
+	_, known = log.segments[0].keys.stale(2)
+	require.False(t, known)
+	require.NoError(t, log.RotateKeys())
+	stale, known = log.segments[0].keys.stale(2)
+	require.True(t, known)
+	require.False(t, stale)
+
+	for off := uint64(0); off < 4; off++ {
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, value, read.Value)
+	}
+
+	// Without the key, records can't be read.
+	writeKeys("3 " + testKey2 + "\n")
+	require.NoError(t, keyring.Reload())
+	_, err = log.Read(0)
+	require.Error(t, err)
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"io"
 	"os"
+	"sort"
 
 	"github.com/tysontate/gommap"
 )
@@ -44,7 +45,12 @@ func newIndex(f *os.File, c Config) (*index, error) {
 	// We can't resize it after we mmap the file.
 	// This will add some unknown amount of space
 	// between the last entry and the file's end.
-	if err := os.Truncate(f.Name(), int64(c.Segment.MaxIndexBytes)); err != nil {
+	// An index written with a larger MaxIndexBytes keeps its entries.
+	max := c.Segment.MaxIndexBytes
+	if idx.size > max {
+		max = idx.size
+	}
+	if err := os.Truncate(f.Name(), int64(max)); err != nil {
 		return nil, err
 	}
 
@@ -110,6 +116,23 @@ func (i *index) Read(offset int64) (output uint32, pos uint64, err error) {
 	return output, pos, nil
 }
 
+// Floor returns the last entry whose offset is at or before the given
+// relative offset, or io.EOF if there's none. Entries are sorted by offset,
+// but a sparse index or compaction leaves gaps between them, so Floor
+// binary searches instead of computing the entry's position.
+func (i *index) Floor(offset uint32) (output uint32, pos uint64, err error) {
+	entries := int(i.size / uint64(entryWidth))
+	in := sort.Search(entries, func(in int) bool {
+		off, _, _ := i.Read(int64(in))
+		return off > offset
+	})
+	if in == 0 {
+		return 0, 0, io.EOF
+	}
+
+	return i.Read(int64(in - 1))
+}
+
 // Write appends the given offset and position to the index.
 // first validates that there is enough space to the write
 // the entry. If so, the offset and position are encoded and
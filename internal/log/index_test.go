@@ -60,4 +60,19 @@ func TestIndex(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, uint32(2), off)
 	require.Equal(t, entries[2].Position, pos)
+
+	// Floor finds the closest entry at or before an offset.
+	require.NoError(t, idx.Write(5, 50))
+	off, pos, err = idx.Floor(3)
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), off)
+	require.Equal(t, uint64(20), pos)
+
+	off, _, err = idx.Floor(1)
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), off)
+
+	off, _, err = idx.Floor(6)
+	require.NoError(t, err)
+	require.Equal(t, uint32(5), off)
 }
@@ -0,0 +1,341 @@
+package log
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+
+	api "github.com/hindenbug/dlog/api/log/v1"
+)
+
+// Inspector reads a log's files straight from its directory without
+// opening the log, so nothing on disk is repaired or otherwise changed.
+// It's meant for looking into the data directory of a stopped or
+// misbehaving node. Config only needs the keyring of an encrypted log, and
+// Compaction.Enabled if gaps between offsets are expected. Archived
+// segments are listed, but their records aren't read.
+type Inspector struct {
+	Dir    string
+	Config Config
+}
+
+// SegmentInfo describes a segment found in a log's directory. NextOffset
+// and Records only account for the records that read back intact. The
+// records and files of archived segments aren't counted.
+type SegmentInfo struct {
+	BaseOffset     uint64
+	NextOffset     uint64
+	Archived       bool
+	Records        uint64
+	StoreBytes     uint64
+	IndexBytes     uint64
+	TimeIndexBytes uint64
+}
+
+// Problem is something wrong Verify found with a segment.
+type Problem struct {
+	BaseOffset uint64
+	Msg        string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("segment %d: %s", p.BaseOffset, p.Msg)
+}
+
+// Segments describes every segment in the log's directory, oldest first.
+func (in *Inspector) Segments() ([]SegmentInfo, error) {
+	segments, err := in.segments()
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]SegmentInfo, len(segments))
+	for i, s := range segments {
+		info := SegmentInfo{BaseOffset: s.baseOffset, NextOffset: s.baseOffset}
+		if s.archive != nil {
+			info.NextOffset, info.Archived = s.nextOffset, true
+			infos[i] = info
+			continue
+		}
+		// A record that doesn't read back just ends the listing of its
+		// segment; Verify tells what's wrong with it.
+		_ = s.scan(func(_ uint64, record *api.Record) error {
+			info.NextOffset = record.Offset + 1
+			info.Records++
+			return nil
+		})
+
+		sizes := []*uint64{&info.StoreBytes, &info.IndexBytes, &info.TimeIndexBytes}
+		for j, ext := range []string{".store", ".index", ".timeindex"} {
+			fi, err := os.Stat(s.path(ext))
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			*sizes[j] = uint64(fi.Size())
+		}
+		infos[i] = info
+	}
+
+	return infos, nil
+}
+
+// Records calls fn with every record whose offset is in [from, to), in
+// offset order.
+func (in *Inspector) Records(from, to uint64, fn func(*api.Record) error) error {
+	segments, err := in.segments()
+	if err != nil {
+		return err
+	}
+
+	for _, s := range segments {
+		if s.baseOffset >= to {
+			break
+		}
+		if s.archive != nil {
+			continue
+		}
+		err := s.scan(func(_ uint64, record *api.Record) error {
+			if record.Offset < from || record.Offset >= to {
+				return nil
+			}
+			return fn(record)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Verify checks every segment in the log's directory and returns the
+// problems it found: records that fail to read back, offsets that go
+// backwards or skip ahead, and index entries that don't point at the
+// record they name. An error is only returned if the files can't be read
+// at all.
+func (in *Inspector) Verify() ([]Problem, error) {
+	segments, err := in.segments()
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []Problem
+	for i, s := range segments {
+		report := func(format string, args ...interface{}) {
+			problems = append(problems, Problem{s.baseOffset, fmt.Sprintf(format, args...)})
+		}
+
+		if i > 0 {
+			prev := segments[i-1]
+			if s.baseOffset > prev.nextOffset && !in.Config.Compaction.Enabled {
+				report("offsets %d to %d are missing before the segment", prev.nextOffset, s.baseOffset-1)
+			} else if s.baseOffset < prev.nextOffset {
+				report("overlaps the previous segment, which ends at offset %d", prev.nextOffset-1)
+			}
+		}
+		if s.archive != nil {
+			continue
+		}
+
+		// Map every record's position to its offset and every offset to
+		// its timestamp, to check the indexes against.
+		offsets := make(map[uint64]uint64)
+		timestamps := make(map[uint64]int64)
+		var read uint64
+		s.nextOffset = s.baseOffset
+		err := s.scan(func(pos uint64, record *api.Record) error {
+			read = pos + 1
+			switch {
+			case record.Offset < s.nextOffset:
+				report("record at position %d has offset %d, expected at least %d", pos, record.Offset, s.nextOffset)
+			case record.Offset > s.nextOffset && !in.Config.Compaction.Enabled:
+				report("offsets %d to %d are missing before position %d", s.nextOffset, record.Offset-1, pos)
+			}
+			if record.Offset >= s.nextOffset {
+				s.nextOffset = record.Offset + 1
+			}
+			offsets[pos] = record.Offset
+			timestamps[record.Offset] = record.Timestamp
+			return nil
+		})
+		// Index entries past a bad record can't be checked.
+		readPos, readOffset := uint64(math.MaxUint64), uint64(math.MaxUint64)
+		if err != nil {
+			report("%v", err)
+			readPos, readOffset = read, s.nextOffset
+		}
+
+		if err := s.verifyIndex(offsets, readPos, report); err != nil {
+			return nil, err
+		}
+		if err := s.verifyTimeIndex(timestamps, readOffset, report); err != nil {
+			return nil, err
+		}
+	}
+
+	return problems, nil
+}
+
+// verifyIndex checks that the segment's index entries are in order and
+// each entry before readPos points at the start of the record with the
+// entry's offset.
+func (s *segment) verifyIndex(offsets map[uint64]uint64, readPos uint64, report func(string, ...interface{})) error {
+	b, err := ioutil.ReadFile(s.path(".index"))
+	if os.IsNotExist(err) {
+		report("index is missing")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(b)%entryWidth != 0 {
+		report("index size %d isn't a multiple of the entry size; it wasn't closed cleanly", len(b))
+	}
+	if len(b) == 0 && len(offsets) > 0 {
+		report("index is empty")
+	}
+
+	for i := 0; (i+1)*entryWidth <= len(b); i++ {
+		entry := b[i*entryWidth:]
+		off := s.baseOffset + uint64(binary.BigEndian.Uint32(entry[:offsetWidth]))
+		pos := binary.BigEndian.Uint64(entry[offsetWidth:entryWidth])
+
+		if i > 0 {
+			prev := b[(i-1)*entryWidth:]
+			prevOff := s.baseOffset + uint64(binary.BigEndian.Uint32(prev[:offsetWidth]))
+			prevPos := binary.BigEndian.Uint64(prev[offsetWidth:entryWidth])
+			if off <= prevOff || pos <= prevPos {
+				report("index entries stop increasing at entry %d; it wasn't closed cleanly", i)
+				return nil
+			}
+		}
+
+		actual, ok := offsets[pos]
+		switch {
+		case pos >= readPos:
+		case !ok:
+			report("index entry %d for offset %d points at position %d, where no record starts", i, off, pos)
+		case actual != off:
+			report("index entry %d for offset %d points at the record with offset %d", i, off, actual)
+		}
+	}
+
+	return nil
+}
+
+// verifyTimeIndex checks that the segment's time index entries are in
+// order and each entry before readOffset names a record with the entry's
+// timestamp.
+func (s *segment) verifyTimeIndex(timestamps map[uint64]int64, readOffset uint64, report func(string, ...interface{})) error {
+	b, err := ioutil.ReadFile(s.path(".timeindex"))
+	if os.IsNotExist(err) {
+		report("time index is missing")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(b)%timeEntryWidth != 0 {
+		report("time index size %d isn't a multiple of the entry size; it wasn't closed cleanly", len(b))
+	}
+
+	var prevTs int64
+	for i := 0; (i+1)*timeEntryWidth <= len(b); i++ {
+		entry := b[i*timeEntryWidth:]
+		ts := int64(binary.BigEndian.Uint64(entry[:timestampWidth]))
+		off := s.baseOffset + uint64(binary.BigEndian.Uint32(entry[timestampWidth:timeEntryWidth]))
+
+		if ts <= prevTs {
+			report("time index entries stop increasing at entry %d; it wasn't closed cleanly", i)
+			return nil
+		}
+		prevTs = ts
+
+		actual, ok := timestamps[off]
+		switch {
+		case off >= readOffset:
+		case !ok:
+			report("time index entry %d names offset %d, which isn't in the segment", i, off)
+		case actual != ts:
+			report("time index entry %d has timestamp %d, but offset %d has %d", i, ts, off, actual)
+		}
+	}
+
+	return nil
+}
+
+// segments returns the segments in the log's directory without opening
+// their files.
+func (in *Inspector) segments() ([]*segment, error) {
+	baseOffsets, archived, err := readBaseOffsets(in.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	segments := make([]*segment, len(baseOffsets))
+	for i, off := range baseOffsets {
+		s := &segment{dir: in.Dir, baseOffset: off, nextOffset: off, config: in.Config}
+		if archived[off] {
+			if s.archive, err = readArchiveMarker(s.path(archivedExt)); err != nil {
+				return nil, err
+			}
+			s.nextOffset = s.archive.NextOffset
+		}
+		segments[i] = s
+	}
+
+	return segments, nil
+}
+
+// scan reads the segment's store file from the start, without opening the
+// segment, and calls fn with every record and its position. It stops at
+// the first record that can't be read back and returns why.
+func (s *segment) scan(fn func(pos uint64, record *api.Record) error) error {
+	f, err := os.Open(s.path(".store"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	size := uint64(fi.Size())
+	r := bufio.NewReader(f)
+	for pos := uint64(0); pos < size; {
+		raw, attributes, err := readRecord(r, pos, size)
+		if _, ok := err.(api.ErrCorruptRecord); ok {
+			return fmt.Errorf("record at position %d is corrupt", pos)
+		}
+		if err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("record at position %d is cut short", pos)
+		}
+		if err != nil {
+			return err
+		}
+
+		p, err := openPayload(s.config.Encryption.Keyring, raw, attributes)
+		if err != nil {
+			return fmt.Errorf("record at position %d: %w", pos, err)
+		}
+		record, err := s.decode(p, attributes)
+		if err != nil {
+			return fmt.Errorf("record at position %d: %w", pos, err)
+		}
+		if err = fn(pos, record); err != nil {
+			return err
+		}
+		pos += headerWidth + uint64(len(raw))
+	}
+
+	return nil
+}
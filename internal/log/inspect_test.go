@@ -0,0 +1,87 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api "github.com/hindenbug/dlog/api/log/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInspector(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inspector-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 100
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 6; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+
+	in := &Inspector{Dir: dir}
+	infos, err := in.Segments()
+	require.NoError(t, err)
+	require.Equal(t, len(log.segments), len(infos))
+	var records uint64
+	for i, info := range infos {
+		require.Equal(t, log.segments[i].baseOffset, info.BaseOffset)
+		require.Equal(t, log.segments[i].nextOffset, info.NextOffset)
+		require.Equal(t, log.segments[i].closedSize, info.StoreBytes+info.IndexBytes+info.TimeIndexBytes)
+		records += info.Records
+	}
+	require.Equal(t, uint64(6), records)
+
+	var offsets []uint64
+	err = in.Records(2, 5, func(record *api.Record) error {
+		offsets = append(offsets, record.Offset)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{2, 3, 4}, offsets)
+
+	problems, err := in.Verify()
+	require.NoError(t, err)
+	require.Empty(t, problems)
+
+	// Flip a bit in the last byte of the first store.
+	s := log.segments[0]
+	b, err := ioutil.ReadFile(s.path(".store"))
+	require.NoError(t, err)
+	b[len(b)-1] ^= 0x01
+	require.NoError(t, ioutil.WriteFile(s.path(".store"), b, 0644))
+
+	problems, err = in.Verify()
+	require.NoError(t, err)
+	require.NotEmpty(t, problems)
+	require.Equal(t, s.baseOffset, problems[0].BaseOffset)
+	require.Contains(t, problems[0].Msg, "is corrupt")
+
+	// Losing a whole segment leaves a gap.
+	b[len(b)-1] ^= 0x01
+	require.NoError(t, ioutil.WriteFile(s.path(".store"), b, 0644))
+	require.Greater(t, len(log.segments), 2)
+	lost, next := log.segments[1], log.segments[2]
+	require.NoError(t, os.Remove(lost.path(".store")))
+
+	problems, err = in.Verify()
+	require.NoError(t, err)
+	require.Equal(t, []Problem{{
+		BaseOffset: next.baseOffset,
+		Msg:        fmt.Sprintf("offsets %d to %d are missing before the segment", lost.baseOffset, next.baseOffset-1),
+	}}, problems)
+
+	// Compaction can remove a segment's last records, so gaps are
+	// expected in a compacted log.
+	in.Config.Compaction.Enabled = true
+	problems, err = in.Verify()
+	require.NoError(t, err)
+	require.Empty(t, problems)
+}
@@ -0,0 +1,192 @@
+package log
+
+import (
+	"bufio"
+	"io"
+
+	api "github.com/hindenbug/dlog/api/log/v1"
+)
+
+// Iterator walks a log's records in offset order. It reads each segment's
+// store sequentially through a buffered reader instead of looking every
+// record up in the index, and moves on to the next segment when it reaches
+// the end of one.
+type Iterator struct {
+	log *Log
+
+	// next is the offset of the next record to return.
+	next    uint64
+	segment *segment
+	pos     uint64
+	// reader reads the segment's store from where the iterator is up to
+	// end, the store's size when the reader was made.
+	store  *store
+	reader *bufio.Reader
+	end    uint64
+
+	record *api.Record
+	err    error
+	closed bool
+}
+
+// Iterator returns an iterator starting at the record with the given
+// offset, or at the next record the log holds if compaction removed it.
+func (l *Log) Iterator(from uint64) *Iterator {
+	return &Iterator{log: l, next: from}
+}
+
+// Next moves the iterator to the next record and reports whether there is
+// one. It returns false when it reaches the end of the log or an error,
+// which Err returns. At the end of the log, calling Next again picks up
+// any records appended since.
+func (it *Iterator) Next() bool {
+	for {
+		if it.err != nil || it.closed {
+			return false
+		}
+		if it.advance() {
+			return true
+		}
+		// Archived segments are fetched without holding the log's lock.
+		f, ok := it.err.(errFetch)
+		if !ok {
+			return false
+		}
+		it.err = it.log.fetch(f.segment)
+	}
+}
+
+// advance does the work of Next while holding the log's lock.
+func (it *Iterator) advance() bool {
+	it.log.mu.RLock()
+	defer it.log.mu.RUnlock()
+
+	for {
+		// The segment may have been removed or rewritten since the last
+		// call, in which case the iterator finds its place again.
+		if it.segment == nil || it.segment.closed {
+			if !it.seek() {
+				return false
+			}
+		}
+
+		record, err := it.read()
+		if err == io.EOF {
+			if it.segment == it.log.activeSegment {
+				return false
+			}
+			// Compaction may have removed the segment's last records.
+			if it.next < it.segment.nextOffset {
+				it.next = it.segment.nextOffset
+			}
+			it.segment = nil
+			continue
+		}
+		if err != nil {
+			it.err = err
+			return false
+		}
+		if record.Offset < it.next {
+			continue
+		}
+
+		it.record = record
+		it.next = record.Offset + 1
+		return true
+	}
+}
+
+// read reads the record at the iterator's position in its segment, or
+// returns io.EOF at the end of the segment.
+func (it *Iterator) read() (*api.Record, error) {
+	s := it.segment
+	if err := it.log.acquire(s); err != nil {
+		return nil, err
+	}
+	defer it.log.release(s)
+
+	// The segment's files may have been closed and reopened since the
+	// reader was made.
+	if s.store != it.store {
+		it.store, it.reader = s.store, nil
+	}
+	if it.pos >= s.store.size {
+		return nil, io.EOF
+	}
+
+	if it.reader == nil || it.pos >= it.end {
+		if err := s.store.Flush(); err != nil {
+			return nil, err
+		}
+		it.end = s.store.size
+		it.reader = bufio.NewReader(
+			io.NewSectionReader(s.store.File, int64(it.pos), int64(it.end-it.pos)),
+		)
+	}
+	raw, attributes, err := readRecord(it.reader, it.pos, s.store.size)
+	if corrupt, ok := err.(api.ErrCorruptRecord); ok {
+		corrupt.Offset = it.next
+		return nil, corrupt
+	}
+	if err != nil {
+		return nil, err
+	}
+	it.pos += headerWidth + uint64(len(raw))
+
+	p, err := s.store.open(raw, attributes)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.decode(p, attributes)
+}
+
+// seek finds the segment holding the next record and positions the
+// iterator at it. It returns false if there's no such record yet, or if
+// the record was removed from the log, in which case it sets the error.
+func (it *Iterator) seek() bool {
+	it.segment, it.store, it.reader = nil, nil, nil
+
+	if it.next < it.log.segments[0].baseOffset {
+		it.err = api.ErrOffsetOutOfRange{Offset: it.next}
+		return false
+	}
+
+	s := it.log.segmentFor(it.next)
+	if s == nil {
+		return false
+	}
+
+	if err := it.log.acquire(s); err != nil {
+		it.err = err
+		return false
+	}
+	defer it.log.release(s)
+
+	pos, err := s.locate(it.next)
+	if err != nil {
+		it.err = err
+		return false
+	}
+
+	it.segment, it.pos = s, pos
+	return true
+}
+
+// Record returns the record Next moved the iterator to.
+func (it *Iterator) Record() *api.Record {
+	return it.record
+}
+
+// Err returns the error that stopped the iterator, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close releases the iterator. Next returns false once it's closed.
+func (it *Iterator) Close() error {
+	it.closed = true
+	it.segment, it.store, it.reader = nil, nil, nil
+
+	return nil
+}
@@ -0,0 +1,96 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api "github.com/hindenbug/dlog/api/log/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIterator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iterator-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(log.segments), 1)
+
+	it := log.Iterator(1)
+	defer it.Close()
+
+	// The iterator crosses segment boundaries and stops at the end.
+	var offsets []uint64
+	for it.Next() {
+		offsets = append(offsets, it.Record().Offset)
+	}
+	require.NoError(t, it.Err())
+	require.Equal(t, []uint64{1, 2, 3, 4}, offsets)
+
+	// Records appended later are picked up where it left off.
+	_, err = log.Append(&api.Record{Value: []byte("hello again")})
+	require.NoError(t, err)
+	require.True(t, it.Next())
+	require.Equal(t, uint64(5), it.Record().Offset)
+	require.Equal(t, []byte("hello again"), it.Record().Value)
+	require.False(t, it.Next())
+
+	// Iterating from an offset that retention removed fails.
+	require.NoError(t, log.Truncate(3))
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Greater(t, lowest, uint64(0))
+
+	it = log.Iterator(0)
+	require.False(t, it.Next())
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 0}, it.Err())
+
+	require.NoError(t, it.Close())
+	it = log.Iterator(lowest)
+	require.True(t, it.Next())
+	require.Equal(t, lowest, it.Record().Offset)
+}
+
+func TestIteratorCorruptRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iterator-corrupt-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	var pos uint64
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		if i == 0 {
+			pos = log.segments[0].store.size
+		}
+	}
+
+	// Damage the second record's payload.
+	f, err := os.OpenFile(log.segments[0].store.Name(), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("j"), int64(pos+headerWidth))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	it := log.Iterator(0)
+	defer it.Close()
+	require.True(t, it.Next())
+	require.False(t, it.Next())
+	require.Equal(t, api.ErrCorruptRecord{Offset: 1, Pos: pos}, it.Err())
+}
@@ -1,6 +1,8 @@
 package log
 
 import (
+	"container/list"
+	"context"
 	"io"
 	"io/ioutil"
 	"os"
@@ -9,8 +11,10 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	api "github.com/hindenbug/dlog/api/log/v1"
+	"go.uber.org/zap"
 )
 
 type Log struct {
@@ -21,35 +25,124 @@ type Log struct {
 
 	activeSegment *segment
 	segments      []*segment
+
+	// rewriteMu makes Compact, RotateKeys and Archive take turns, since
+	// they rewrite or move segments without holding mu while they read
+	// them.
+	rewriteMu sync.Mutex
+
+	// openMu guards the list of segments with open files, which readers
+	// update while holding mu for reading.
+	openMu sync.Mutex
+	open   *list.List
+
+	// unsynced counts the records appended since the last fsync, for the
+	// SyncPeriodic durability policy.
+	unsynced  uint64
+	lastSync  time.Time
+	syncTimer *time.Timer
+
+	// appendedMu guards appended, which Wait creates while holding mu for
+	// reading. appended is closed, waking every waiter, when records are
+	// appended or the log is closed.
+	appendedMu sync.Mutex
+	appended   chan struct{}
 }
 
 func NewLog(dir string, c Config) (*Log, error) {
-	if c.Segment.MaxStoreBytes == 0 {
-		c.Segment.MaxStoreBytes = 1024
+	c = c.withDefaults()
+	log := &Log{Dir: dir, Config: c, lastSync: time.Now(), open: list.New()}
+
+	return log, log.setup()
+}
+
+func (l *Log) setup() error {
+	baseOffsets, archived, err := readBaseOffsets(l.Dir)
+	if err != nil {
+		return err
+	}
+	if err = os.RemoveAll(path.Join(l.Dir, cacheDir)); err != nil {
+		return err
 	}
 
-	if c.Segment.MaxIndexBytes == 0 {
-		c.Segment.MaxIndexBytes = 1024
+	// Only the last segment, which becomes the active one, is opened. The
+	// others are opened when they're first read.
+	for i, off := range baseOffsets {
+		if archived[off] {
+			s, err := loadArchivedSegment(l.Dir, off, l.Config)
+			if err != nil {
+				return err
+			}
+			l.segments = append(l.segments, s)
+			continue
+		}
+		if i == len(baseOffsets)-1 {
+			if err = l.newSegment(off); err != nil {
+				return err
+			}
+			break
+		}
+
+		s, err := loadSegment(l.Dir, off, l.Config)
+		if err != nil {
+			return err
+		}
+		l.segments = append(l.segments, s)
+		if s.store != nil {
+			l.track(s)
+		}
 	}
 
-	log := &Log{Dir: dir, Config: c}
+	// Compaction can remove a segment's last records, so its next offset
+	// is taken from the segment after it.
+	for i := 0; i < len(l.segments)-1; i++ {
+		if next := l.segments[i+1].baseOffset; l.segments[i].nextOffset < next {
+			l.segments[i].nextOffset = next
+		}
+	}
 
-	return log, log.setup()
+	// nil is the zero value for a slice, check if the log is new (no segments)
+	if l.segments == nil {
+		if err = l.newSegment(l.Config.Segment.InitialOffset); err != nil {
+			return err
+		}
+	}
+	// The active segment is never archived, but a new one is needed if
+	// the local ones are gone.
+	if l.activeSegment == nil {
+		if err = l.newSegment(l.segments[len(l.segments)-1].nextOffset); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (l *Log) setup() error {
-	files, err := ioutil.ReadDir(l.Dir)
+// readBaseOffsets returns the base offsets of the segments in dir, in
+// order, and which of them are archived.
+func readBaseOffsets(dir string) ([]uint64, map[uint64]bool, error) {
+	files, err := ioutil.ReadDir(dir)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
 	var baseOffsets []uint64
+	archived := make(map[uint64]bool)
 
 	// Get all the base offsets for the existing segments. This is posible because
-	// the .index and .store files have their base offset as their name.
+	// the .store files have their base offset as their name. The store is the
+	// source of truth for a segment; a missing index is rebuilt from it.
+	// Archived segments leave a marker in place of their files, which
+	// takes precedence over any files an archive left behind.
 	for _, file := range files {
-		offsetStore := strings.TrimSuffix(file.Name(), path.Ext(file.Name()))
+		ext := path.Ext(file.Name())
+		if ext != ".store" && ext != archivedExt {
+			continue
+		}
+		offsetStore := strings.TrimSuffix(file.Name(), ext)
 		off, _ := strconv.ParseUint(offsetStore, 10, 0)
+		if ext == archivedExt {
+			archived[off] = true
+		}
 		baseOffsets = append(baseOffsets, off)
 	}
 
@@ -57,24 +150,15 @@ func (l *Log) setup() error {
 		return baseOffsets[i] < baseOffsets[j]
 	})
 
-	// Create a segment for each of the base offsets.
-	for i := 0; i < len(baseOffsets); i++ {
-		if err = l.newSegment(baseOffsets[i]); err != nil {
-			return err
-
+	// Drop the duplicates of segments with both a marker and a store.
+	unique := baseOffsets[:0]
+	for i, off := range baseOffsets {
+		if i == 0 || off != baseOffsets[i-1] {
+			unique = append(unique, off)
 		}
-		// baseOffsets contains 2 entries for each base offset,
-		// one for the index and one for the store. dedup.
-		i++
 	}
 
-	// nil is the zero value for a slice, check if the log is new (no segments)
-	if l.segments == nil {
-		if err = l.newSegment(l.Config.Segment.InitialOffset); err != nil {
-			return err
-		}
-	}
-	return nil
+	return unique, archived, nil
 }
 
 func (l *Log) newSegment(off uint64) error {
@@ -86,6 +170,7 @@ func (l *Log) newSegment(off uint64) error {
 
 	l.segments = append(l.segments, s)
 	l.activeSegment = s
+	l.track(s)
 	return nil
 }
 
@@ -93,54 +178,431 @@ func (l *Log) Append(record *api.Record) (uint64, error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	offset, err := l.activeSegment.Append(record)
-	if err != nil {
+	return l.appendBatch([]*api.Record{record})
+}
+
+// AppendBatch appends the records under a single lock acquisition and
+// returns the offset of the first one; the rest follow it in order. The
+// batch rolls over to new segments as each one fills up. A batch is
+// appended as a whole or not at all: if any record fails, the log is
+// truncated back to where it was, so retrying the batch doesn't append
+// its records twice.
+func (l *Log) AppendBatch(records []*api.Record) (firstOffset uint64, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.appendBatch(records)
+}
+
+func (l *Log) appendBatch(records []*api.Record) (first uint64, err error) {
+	if l.activeSegment.closed {
+		return 0, os.ErrClosed
+	}
+
+	// The segment the batch starts in is kept open until it's done, so
+	// it can be truncated back if the batch fails.
+	start, active := len(l.segments), l.activeSegment
+	if err = l.acquire(active); err != nil {
 		return 0, err
 	}
+	defer l.release(active)
+	m := active.mark()
+	defer func() {
+		if err == nil {
+			l.notify()
+		} else if rerr := l.rollback(start, m); rerr != nil {
+			err = rerr
+		}
+	}()
+
+	for len(records) > 0 {
+		n, err := l.activeSegment.AppendBatch(records)
+		if err != nil {
+			return 0, err
+		}
+		records = records[n:]
+
+		if err = l.persist(uint64(n)); err != nil {
+			return 0, err
+		}
+
+		if l.activeSegment.IsMaxed() {
+			// Records still waiting for a periodic sync must be synced
+			// before their segment stops being the active one.
+			if l.unsynced > 0 {
+				if err = l.sync(); err != nil {
+					return 0, err
+				}
+			}
+			if err = l.newSegment(l.activeSegment.nextOffset); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return m.nextOffset, nil
+}
+
+// rollback removes the segments from the start-th on, and truncates the
+// one before them back to the mark, making it the active segment again.
+// It must be called with l.mu held.
+func (l *Log) rollback(start int, m segmentMark) error {
+	for _, s := range l.segments[start:] {
+		if err := l.remove(s); err != nil {
+			return err
+		}
+	}
+	l.segments = l.segments[:start]
+	l.activeSegment = l.segments[start-1]
+
+	return l.activeSegment.truncate(m)
+}
+
+// persist makes n just appended records as durable as the log's
+// durability policy asks. It must be called with l.mu held.
+func (l *Log) persist(n uint64) error {
+	d := l.Config.Durability
+	switch d.Policy {
+	case SyncAlways:
+		return l.sync()
+	case SyncPeriodic:
+		l.unsynced += n
+		if (d.Records > 0 && l.unsynced >= d.Records) ||
+			(d.Interval > 0 && time.Since(l.lastSync) >= d.Interval) {
+			return l.sync()
+		}
+		// Make sure the records are synced in time even if no more
+		// appends come along.
+		if d.Interval > 0 && l.syncTimer == nil {
+			l.syncTimer = time.AfterFunc(d.Interval-time.Since(l.lastSync), l.syncLater)
+		}
+		return nil
+	default:
+		return l.activeSegment.store.Flush()
+	}
+}
+
+// sync fsyncs the active segment's store. It must be called with l.mu held.
+func (l *Log) sync() error {
+	if err := l.activeSegment.store.Sync(); err != nil {
+		return err
+	}
+
+	l.unsynced = 0
+	l.lastSync = time.Now()
+	if l.syncTimer != nil {
+		l.syncTimer.Stop()
+		l.syncTimer = nil
+	}
+	return nil
+}
+
+func (l *Log) syncLater() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.syncTimer = nil
+	if l.unsynced == 0 {
+		return
+	}
+	if err := l.sync(); err != nil {
+		zap.L().Named("log").Error(
+			"failed to sync log",
+			zap.String("dir", l.Dir),
+			zap.Error(err),
+		)
+	}
+}
+
+// Sync fsyncs every record appended to the log so far. Only the stores are
+// synced: the indexes of a log that wasn't closed cleanly are rebuilt from
+// its stores when it's opened.
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, s := range l.segments {
+		if s.store == nil {
+			continue
+		}
+		if err := s.store.Sync(); err != nil {
+			return err
+		}
+	}
+
+	return l.sync()
+}
+
+// Wait blocks until the log holds a record at or above the given offset,
+// that is until its next offset is past it. It returns ctx's error if ctx
+// is done first, and os.ErrClosed if the log is closed.
+func (l *Log) Wait(ctx context.Context, offset uint64) error {
+	for {
+		l.mu.RLock()
+		if l.activeSegment.closed {
+			l.mu.RUnlock()
+			return os.ErrClosed
+		}
+		if l.activeSegment.nextOffset > offset {
+			l.mu.RUnlock()
+			return nil
+		}
+		// Appends hold mu, so none can slip in before the channel is
+		// taken.
+		appended := l.appendedChan()
+		l.mu.RUnlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-appended:
+		}
+	}
+}
 
-	if l.activeSegment.IsMaxed() {
-		err = l.newSegment(offset + 1)
+func (l *Log) appendedChan() chan struct{} {
+	l.appendedMu.Lock()
+	defer l.appendedMu.Unlock()
+
+	if l.appended == nil {
+		l.appended = make(chan struct{})
 	}
+	return l.appended
+}
+
+// notify wakes the log's waiters. It must be called with l.mu held.
+func (l *Log) notify() {
+	l.appendedMu.Lock()
+	defer l.appendedMu.Unlock()
 
-	return offset, err
+	if l.appended != nil {
+		close(l.appended)
+		l.appended = nil
+	}
 }
 
-func (l *Log) Read(offset uint64) (*api.Record, error) {
+// Read returns the record at the given offset. If compaction removed it,
+// the next record the log holds is returned instead.
+func (l *Log) Read(offset uint64) (record *api.Record, err error) {
+	err = l.fetching(func() error {
+		record, err = l.read(offset)
+		return err
+	})
+	return record, err
+}
+
+func (l *Log) read(offset uint64) (*api.Record, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 
-	var s *segment
-	for _, segmnt := range l.segments {
-		if segmnt.baseOffset <= offset && offset < segmnt.nextOffset {
-			s = segmnt
-			break
+	i := l.segmentIndex(offset)
+	if i < 0 {
+		return nil, api.ErrOffsetOutOfRange{Offset: offset}
+	}
+
+	// A compacted segment may not hold any record at or after the offset,
+	// in which case the next segment's first record is the one.
+	for ; i < len(l.segments); i++ {
+		record, err := l.readSegment(l.segments[i], offset)
+		if err != io.EOF {
+			return record, err
 		}
 	}
 
-	if s == nil || s.nextOffset <= offset {
-		return nil, api.ErrOffsetOutOfRange{Offset: offset}
+	return nil, api.ErrOffsetOutOfRange{Offset: offset}
+}
+
+func (l *Log) readSegment(s *segment, offset uint64) (*api.Record, error) {
+	if err := l.acquire(s); err != nil {
+		return nil, err
 	}
+	defer l.release(s)
 
 	return s.Read(offset)
 }
 
+// segmentFor returns the segment holding the given offset, or nil if the
+// log doesn't hold it. It must be called with l.mu held.
+func (l *Log) segmentFor(offset uint64) *segment {
+	i := l.segmentIndex(offset)
+	if i < 0 {
+		return nil
+	}
+
+	return l.segments[i]
+}
+
+// segmentIndex returns the index of the segment holding the given offset,
+// or -1 if the log doesn't hold it. It must be called with l.mu held.
+func (l *Log) segmentIndex(offset uint64) int {
+	i := sort.Search(len(l.segments), func(i int) bool {
+		return offset < l.segments[i].nextOffset
+	})
+	if i == len(l.segments) || offset < l.segments[i].baseOffset {
+		return -1
+	}
+
+	return i
+}
+
+// LowestOffset returns the offset of the oldest record still held by the log.
+func (l *Log) LowestOffset() (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.segments[0].baseOffset, nil
+}
+
+// HighestOffset returns the offset of the most recently appended record.
+// It returns ErrLogEmpty if the log holds no records, either because none
+// were appended or because they were all removed.
+func (l *Log) HighestOffset() (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	off := l.segments[len(l.segments)-1].nextOffset
+	if off == l.segments[0].baseOffset {
+		return 0, api.ErrLogEmpty{}
+	}
+
+	return off - 1, nil
+}
+
+// OffsetForTime returns the offset of the first record whose timestamp is
+// at or after t. If no record is that recent, it returns the offset the
+// next appended record will get, so consumers can start from the tail.
+func (l *Log) OffsetForTime(t time.Time) (off uint64, err error) {
+	err = l.fetching(func() error {
+		off, err = l.offsetForTime(t)
+		return err
+	})
+	return off, err
+}
+
+func (l *Log) offsetForTime(t time.Time) (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	timestamp := t.UnixMilli()
+	for _, s := range l.segments {
+		if s.maxTimestamp >= timestamp {
+			if err := l.acquire(s); err != nil {
+				return 0, err
+			}
+			defer l.release(s)
+
+			return s.offsetForTime(timestamp)
+		}
+	}
+
+	return l.activeSegment.nextOffset, nil
+}
+
+// Truncate removes every segment whose records all sit below the given
+// offset, i.e. whose next offset is at or below lowest. The active segment
+// is always kept so the log can keep accepting appends.
+func (l *Log) Truncate(lowest uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var segments []*segment
+	for _, s := range l.segments {
+		if s != l.activeSegment && s.nextOffset <= lowest {
+			if err := l.remove(s); err != nil {
+				return err
+			}
+			continue
+		}
+		segments = append(segments, s)
+	}
+	l.segments = segments
+
+	return nil
+}
+
+// Clean applies the retention policies from the log's config. It removes the
+// oldest segments, one at a time, for as long as one of them is violated:
+// the segment is older than MaxAge, or the log would still hold at least
+// MaxBytes or MaxRecords without it. The active segment is always kept.
+func (l *Log) Clean() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var size, records uint64
+	for _, s := range l.segments {
+		size += s.size()
+		records += s.nextOffset - s.baseOffset
+	}
+
+	r := l.Config.Retention
+	for len(l.segments) > 1 {
+		s := l.segments[0]
+		count := s.nextOffset - s.baseOffset
+
+		expired := false
+		if r.MaxAge > 0 {
+			modTime, err := s.modTime()
+			if err != nil {
+				return err
+			}
+			expired = time.Since(modTime) > r.MaxAge
+		}
+		tooBig := r.MaxBytes > 0 && size-s.size() >= r.MaxBytes
+		tooMany := r.MaxRecords > 0 && records-count >= r.MaxRecords
+		if !expired && !tooBig && !tooMany {
+			break
+		}
+
+		size -= s.size()
+		records -= count
+		if err := l.remove(s); err != nil {
+			return err
+		}
+		l.segments = l.segments[1:]
+	}
+	return nil
+}
+
 func (l *Log) Close() error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
+	if l.syncTimer != nil {
+		l.syncTimer.Stop()
+		l.syncTimer = nil
+	}
+
 	for _, segment := range l.segments {
+		l.forget(segment)
 		if err := segment.Close(); err != nil {
 			return err
 		}
 	}
+	l.notify()
 
 	return nil
 }
 
+// remove deletes a segment's files. It must be called with l.mu held.
+func (l *Log) remove(s *segment) error {
+	l.forget(s)
+	return s.Remove()
+}
+
+// Remove closes the log and deletes its files, including the ones of its
+// archived segments.
 func (l *Log) Remove() error {
 	if err := l.Close(); err != nil {
 		return err
 	}
+	for _, s := range l.segments {
+		if s.archive == nil {
+			continue
+		}
+		if err := s.removeArchived(); err != nil {
+			return err
+		}
+	}
 	return os.RemoveAll(l.Dir)
 }
 
@@ -152,25 +614,44 @@ func (l *Log) Reset() error {
 	return l.setup()
 }
 
+// Reader returns the raw bytes of every segment's store, oldest first.
+// Records stay compressed and encrypted just as they are on disk.
 func (l *Log) Reader() io.Reader {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 	readers := make([]io.Reader, len(l.segments))
 
 	for i, segment := range l.segments {
-		readers[i] = &originReader{segment.store, 0}
+		readers[i] = &originReader{l, segment, 0}
 	}
 
 	return io.MultiReader(readers...)
 }
 
 type originReader struct {
-	*store
-	offset int64
+	log     *Log
+	segment *segment
+	offset  int64
+}
+
+func (o *originReader) Read(p []byte) (n int, err error) {
+	err = o.log.fetching(func() error {
+		n, err = o.read(p)
+		return err
+	})
+	return n, err
 }
 
-func (o *originReader) Read(p []byte) (int, error) {
-	n, err := o.ReadAt(p, o.offset)
+func (o *originReader) read(p []byte) (int, error) {
+	o.log.mu.RLock()
+	defer o.log.mu.RUnlock()
+
+	if err := o.log.acquire(o.segment); err != nil {
+		return 0, err
+	}
+	defer o.log.release(o.segment)
+
+	n, err := o.segment.store.ReadAt(p, o.offset)
 	o.offset += int64(n)
 
 	return n, err
@@ -1,9 +1,12 @@
 package log
 
 import (
+	"context"
 	"io/ioutil"
 	"os"
+	"path"
 	"testing"
+	"time"
 
 	api "github.com/hindenbug/dlog/api/log/v1"
 	"github.com/stretchr/testify/require"
@@ -16,14 +19,23 @@ func TestLog(t *testing.T) {
 		"offset out of range error":         testOutOfRangeErr,
 		"init with existing segments":       testInitExisting,
 		"reader":                            testReader,
+		"retention removes old segments":    testRetention,
+		"offset bounds":                     testOffsetBounds,
+		"truncate":                          testTruncate,
+		"missing index is rebuilt":          testMissingIndex,
+		"offset for time":                   testOffsetForTime,
+		"keys and headers are persisted":    testKeyHeaders,
+		"append batch":                      testAppendBatch,
+		"wait for appends":                  testWait,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			dir, err := ioutil.TempDir("", "store-test")
 			require.NoError(t, err)
 			defer os.RemoveAll(dir)
 
+			// Each segment holds two records of the tests' size.
 			c := Config{}
-			c.Segment.MaxStoreBytes = 32
+			c.Segment.MaxStoreBytes = 64
 			log, err := NewLog(dir, c)
 			require.NoError(t, err)
 
@@ -75,8 +87,8 @@ func testReader(t *testing.T, log *Log) {
 	require.NoError(t, err)
 
 	read := &api.Record{}
-	// Store writes the length as a prefix to the binary content so we have to skip it.
-	err = proto.Unmarshal(b[limit:], read)
+	// Store writes a header as a prefix to the binary content so we have to skip it.
+	err = proto.Unmarshal(b[headerWidth:], read)
 	require.NoError(t, err)
 	require.Equal(t, apnd.Value, read.Value)
 }
@@ -87,3 +99,466 @@ func testOutOfRangeErr(t *testing.T, log *Log) {
 	apiErr := err.(api.ErrOffsetOutOfRange)
 	require.Equal(t, uint64(1), apiErr.Offset)
 }
+
+func testRetention(t *testing.T, log *Log) {
+	apnd := &api.Record{
+		Value: []byte("hello world"),
+	}
+
+	// Each segment holds two records with the test config.
+	for i := 0; i < 6; i++ {
+		_, err := log.Append(apnd)
+		require.NoError(t, err)
+	}
+
+	// Nothing is removed while the policies hold.
+	require.NoError(t, log.Clean())
+	_, err := log.Read(0)
+	require.NoError(t, err)
+
+	log.Config.Retention.MaxRecords = 2
+	require.NoError(t, log.Clean())
+
+	read, err := log.Read(3)
+	require.Nil(t, read)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 3}, err)
+
+	read, err = log.Read(4)
+	require.NoError(t, err)
+	require.Equal(t, apnd.Value, read.Value)
+
+	log.Config.Retention.MaxAge = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	require.NoError(t, log.Clean())
+
+	_, err = log.Read(5)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 5}, err)
+
+	// The active segment survives, so appends carry on from the same offset.
+	off, err := log.Append(apnd)
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), off)
+}
+
+func testOffsetBounds(t *testing.T, log *Log) {
+	apnd := &api.Record{
+		Value: []byte("hello world"),
+	}
+
+	_, err := log.HighestOffset()
+	require.Equal(t, api.ErrLogEmpty{}, err)
+
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(apnd)
+		require.NoError(t, err)
+	}
+
+	off, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	off, err = log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+}
+
+func testTruncate(t *testing.T, log *Log) {
+	apnd := &api.Record{
+		Value: []byte("hello world"),
+	}
+
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(apnd)
+		require.NoError(t, err)
+	}
+
+	// The first segment holds offsets 0 and 1, so it's only removed once
+	// the lowest offset to keep is past both of them.
+	require.NoError(t, log.Truncate(1))
+	_, err := log.Read(0)
+	require.NoError(t, err)
+
+	require.NoError(t, log.Truncate(2))
+	_, err = log.Read(0)
+	require.Error(t, err)
+
+	off, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+
+	read, err := log.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, apnd.Value, read.Value)
+}
+
+func testMissingIndex(t *testing.T, log *Log) {
+	apnd := &api.Record{
+		Value: []byte("hello world"),
+	}
+
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(apnd)
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+	require.NoError(t, os.Remove(path.Join(log.Dir, "0.index")))
+
+	log, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+
+	for off := uint64(0); off < 3; off++ {
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, read.Offset)
+	}
+}
+
+func testOffsetForTime(t *testing.T, log *Log) {
+	base := time.Date(2021, 9, 1, 9, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{
+			Value:     []byte("hello world"),
+			Timestamp: base.Add(time.Duration(i) * time.Minute).UnixMilli(),
+		})
+		require.NoError(t, err)
+	}
+
+	check := func(log *Log) {
+		off, err := log.OffsetForTime(base.Add(-time.Hour))
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), off)
+
+		off, err = log.OffsetForTime(base.Add(90 * time.Second))
+		require.NoError(t, err)
+		require.Equal(t, uint64(2), off)
+
+		off, err = log.OffsetForTime(base.Add(4 * time.Minute))
+		require.NoError(t, err)
+		require.Equal(t, uint64(4), off)
+
+		// Nothing is that recent, so consumers start at the tail.
+		off, err = log.OffsetForTime(base.Add(time.Hour))
+		require.NoError(t, err)
+		require.Equal(t, uint64(5), off)
+	}
+	check(log)
+
+	// Records without a timestamp get the time they were appended.
+	before := time.Now()
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	read, err := log.Read(off)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, read.Timestamp, before.UnixMilli())
+
+	require.NoError(t, log.Close())
+	log, err = NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	check(log)
+}
+
+func testKeyHeaders(t *testing.T, log *Log) {
+	apnd := &api.Record{
+		Key:   []byte("user-42"),
+		Value: []byte("hello world"),
+		Headers: []*api.Header{
+			{Key: "content-type", Value: []byte("text/plain")},
+			{Key: "trace-id", Value: []byte("abc123")},
+		},
+		Timestamp: 1630486800000,
+	}
+	off, err := log.Append(apnd)
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	log, err = NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+
+	read, err := log.Read(off)
+	require.NoError(t, err)
+	require.True(t, proto.Equal(apnd, read))
+}
+
+func testAppendBatch(t *testing.T, log *Log) {
+	off, err := log.Append(&api.Record{Value: []byte("first")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	// The segments only hold about one record each, so the batch has to
+	// roll over several of them.
+	var batch []*api.Record
+	for i := 0; i < 5; i++ {
+		batch = append(batch, &api.Record{Value: []byte("hello world")})
+	}
+	first, err := log.AppendBatch(batch)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), first)
+	require.Greater(t, len(log.segments), 2)
+
+	for i := uint64(1); i <= 5; i++ {
+		read, err := log.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, i, read.Offset)
+	}
+
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), highest)
+
+	// A batch that fails part way through, after rolling over to new
+	// segments, leaves nothing behind.
+	segments := len(log.segments)
+	batch[3] = &api.Record{
+		Value:   []byte("hello world"),
+		Headers: []*api.Header{{Key: "\xff"}},
+	}
+	_, err = log.AppendBatch(batch)
+	require.Error(t, err)
+	require.Equal(t, segments, len(log.segments))
+	highest, err = log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), highest)
+
+	first, err = log.AppendBatch(batch[:3])
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), first)
+	read, err := log.Read(6)
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), read.Offset)
+}
+
+func TestLogDurability(t *testing.T) {
+	dir, err := ioutil.TempDir("", "durability-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Durability.Policy = SyncPeriodic
+	c.Durability.Records = 2
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	synced := func() bool {
+		log.mu.RLock()
+		defer log.mu.RUnlock()
+		store := log.activeSegment.store
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		return store.synced == store.size
+	}
+	apnd := &api.Record{Value: []byte("hello world")}
+
+	// Every second record triggers a sync.
+	_, err = log.Append(apnd)
+	require.NoError(t, err)
+	require.False(t, synced())
+	_, err = log.Append(apnd)
+	require.NoError(t, err)
+	require.True(t, synced())
+
+	// Records waiting on the interval are synced without another append.
+	log.Config.Durability.Interval = 10 * time.Millisecond
+	_, err = log.Append(apnd)
+	require.NoError(t, err)
+	require.Eventually(t, synced, time.Second, 5*time.Millisecond)
+
+	log.Config.Durability.Policy = SyncAlways
+	_, err = log.Append(apnd)
+	require.NoError(t, err)
+	require.True(t, synced())
+
+	log.Config.Durability.Policy = SyncOS
+	_, err = log.Append(apnd)
+	require.NoError(t, err)
+	require.False(t, synced())
+	require.NoError(t, log.Sync())
+	require.True(t, synced())
+}
+
+func TestLogOpenSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "open-segments-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	c.Segment.MaxOpenSegments = 2
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	for i := 0; i < 6; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(log.segments), 2)
+
+	open := func() int {
+		var n int
+		for _, s := range log.segments {
+			if s.store != nil {
+				n++
+			}
+		}
+		return n
+	}
+	require.Equal(t, 2, open())
+
+	// Closed segments are reopened to be read, and others are closed to
+	// make room for them.
+	for off := uint64(0); off < 6; off++ {
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, read.Offset)
+		require.Equal(t, 2, open())
+	}
+
+	it := log.Iterator(0)
+	defer it.Close()
+	var n uint64
+	for ; it.Next(); n++ {
+		require.Equal(t, n, it.Record().Offset)
+	}
+	require.NoError(t, it.Err())
+	require.Equal(t, uint64(6), n)
+}
+
+func TestLogLazyOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lazy-open-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	c.Segment.MaxIndexBytes = 1024
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	for i := int64(1); i <= 4; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world"), Timestamp: i * 1000})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+
+	require.Greater(t, len(log.segments), 2)
+
+	// Simulate a crash that left the second segment's index at its mmapped
+	// size.
+	crashed := log.segments[1].baseOffset
+	require.NoError(t, os.Truncate(log.segments[1].path(".index"), int64(c.Segment.MaxIndexBytes)))
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	// Only the active segment and the one that needs repairs are open.
+	for _, s := range log.segments {
+		open := s == log.activeSegment || s.baseOffset == crashed
+		require.Equal(t, open, s.store != nil, s.baseOffset)
+	}
+
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), highest)
+
+	off, err := log.OffsetForTime(time.UnixMilli(2500))
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+
+	for off := uint64(0); off < 4; off++ {
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, read.Offset)
+	}
+}
+
+func TestLogSparseIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sparse-index-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 150
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.IndexIntervalBytes = 100
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+
+	// Each record takes up more than 30 bytes, so at most every third one
+	// gets an entry.
+	require.Greater(t, len(log.segments), 1)
+	for _, s := range log.segments {
+		fi, err := os.Stat(s.path(".index"))
+		require.NoError(t, err)
+		records := s.nextOffset - s.baseOffset
+		if records < 2 {
+			continue
+		}
+		require.Less(t, uint64(fi.Size()), records*uint64(entryWidth))
+	}
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	// The closed segments' last offsets are found without repairing them.
+	for _, s := range log.segments {
+		require.Equal(t, s == log.activeSegment, s.store != nil, s.baseOffset)
+	}
+
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(9), highest)
+
+	for off := uint64(0); off < 10; off++ {
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, read.Offset)
+	}
+
+	it := log.Iterator(5)
+	defer it.Close()
+	require.True(t, it.Next())
+	require.Equal(t, uint64(5), it.Record().Offset)
+}
+
+func testWait(t *testing.T, log *Log) {
+	apnd := &api.Record{
+		Value: []byte("hello world"),
+	}
+	_, err := log.Append(apnd)
+	require.NoError(t, err)
+
+	// The record at offset 0 is already there.
+	require.NoError(t, log.Wait(context.Background(), 0))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, log.Wait(ctx, 1))
+
+	waited := make(chan error)
+	go func() {
+		waited <- log.Wait(context.Background(), 1)
+	}()
+	select {
+	case err := <-waited:
+		t.Fatalf("wait returned before the append: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	_, err = log.Append(apnd)
+	require.NoError(t, err)
+	require.NoError(t, <-waited)
+
+	go func() {
+		waited <- log.Wait(context.Background(), 2)
+	}()
+	require.NoError(t, log.Close())
+	require.Equal(t, os.ErrClosed, <-waited)
+}
@@ -0,0 +1,176 @@
+package log
+
+import (
+	"fmt"
+	"os"
+
+	"go.uber.org/zap"
+)
+
+// A log keeps at most Config.Segment.MaxOpenSegments segments' files
+// open. When it goes over, it closes the least recently used inactive
+// segments, and reopens them the next time they're read. Segments being
+// read are never closed, so the limit can be exceeded for a while.
+
+// acquire opens the segment's files if they're closed and marks it as the
+// most recently used segment. Its files stay open until it's released.
+// An archived segment's files have to be fetched first: acquire returns
+// errFetch if they aren't in the cache, since fetching them can take a
+// while and callers hold l.mu. They release it, call fetch and try again.
+func (l *Log) acquire(s *segment) error {
+	l.openMu.Lock()
+	defer l.openMu.Unlock()
+
+	if s.closed {
+		return os.ErrClosed
+	}
+	if s.store == nil {
+		if s.archive != nil && !s.fetched {
+			return errFetch{s}
+		}
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	s.refs++
+	l.touch(s)
+
+	return nil
+}
+
+// errFetch is returned by acquire for an archived segment whose files
+// aren't in the cache.
+type errFetch struct {
+	segment *segment
+}
+
+func (e errFetch) Error() string {
+	return fmt.Sprintf("segment %d has to be fetched from the archiver", e.segment.baseOffset)
+}
+
+// fetching calls fn, which takes l.mu itself, until it no longer fails
+// with errFetch. The segment each failure names is fetched in between,
+// without holding l.mu, so appends and other reads don't wait on the
+// archiver. The files may be evicted again before fn gets to open them,
+// in which case they're fetched again.
+func (l *Log) fetching(fn func() error) error {
+	for {
+		err := fn()
+		f, ok := err.(errFetch)
+		if !ok {
+			return err
+		}
+		if err = l.fetch(f.segment); err != nil {
+			return err
+		}
+	}
+}
+
+// fetch downloads the archived segment's files into the cache unless
+// they're already there. Concurrent readers of the segment wait for a
+// single download. It's called without holding l.mu, which is only taken
+// to check on the segment before and after the download.
+func (l *Log) fetch(s *segment) error {
+	s.fetchMu.Lock()
+	defer s.fetchMu.Unlock()
+
+	l.mu.RLock()
+	l.openMu.Lock()
+	done := s.closed || s.store != nil || s.fetched
+	l.openMu.Unlock()
+	l.mu.RUnlock()
+	if done {
+		return nil
+	}
+
+	err := s.fetch()
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	l.openMu.Lock()
+	defer l.openMu.Unlock()
+
+	// Retention may have removed the segment during the download. Its
+	// files are of no use then, and the reader finds it gone when it
+	// tries again.
+	if s.closed {
+		if err != nil {
+			return nil
+		}
+		return s.removeFiles()
+	}
+	if err != nil {
+		return err
+	}
+	s.fetched = true
+
+	return nil
+}
+
+// release lets the segment's files be closed again.
+func (l *Log) release(s *segment) {
+	l.openMu.Lock()
+	defer l.openMu.Unlock()
+
+	s.refs--
+}
+
+// track adds a segment that was just opened to the open segments.
+func (l *Log) track(s *segment) {
+	l.openMu.Lock()
+	defer l.openMu.Unlock()
+
+	l.touch(s)
+}
+
+// forget drops a segment that's closed for good from the open segments.
+func (l *Log) forget(s *segment) {
+	l.openMu.Lock()
+	defer l.openMu.Unlock()
+
+	if s.lru != nil {
+		l.open.Remove(s.lru)
+		s.lru = nil
+	}
+}
+
+// touch moves the segment to the front of the open segments and closes
+// the least recently used ones over the limit. It must be called with
+// l.openMu held.
+func (l *Log) touch(s *segment) {
+	if s.lru == nil {
+		s.lru = l.open.PushFront(s)
+	} else {
+		l.open.MoveToFront(s.lru)
+	}
+
+	max := int(l.Config.Segment.MaxOpenSegments)
+	if max == 0 {
+		return
+	}
+	for e := l.open.Back(); e != nil && l.open.Len() > max; {
+		prev := e.Prev()
+		if victim := e.Value.(*segment); victim.refs == 0 && victim != l.activeSegment {
+			if err := l.evict(victim); err != nil {
+				zap.L().Named("log").Error(
+					"failed to close segment",
+					zap.String("dir", l.Dir),
+					zap.Uint64("base_offset", victim.baseOffset),
+					zap.Error(err),
+				)
+			}
+			l.open.Remove(e)
+			victim.lru = nil
+		}
+		e = prev
+	}
+}
+
+// evict syncs and closes the segment's files.
+func (l *Log) evict(s *segment) error {
+	if err := s.store.Sync(); err != nil {
+		return err
+	}
+
+	return s.closeFiles()
+}
@@ -0,0 +1,202 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	api "github.com/hindenbug/dlog/api/log/v1"
+)
+
+// repair makes the segment's index and store agree after an unclean
+// shutdown. When the process dies before index.Close truncates the index,
+// the file is left at MaxIndexBytes with zeroed entries after the real
+// ones, and the store may end with a partially written record.
+//
+// repair keeps the longest prefix of index entries whose offsets and
+// positions keep increasing and whose last record reads back intact, then
+// indexes the rest of the store from there. A missing index is simply
+// rebuilt from the whole store. Either way repair works out the segment's
+// next offset, which a sparse index can't tell on its own.
+func (s *segment) repair() error {
+	var (
+		valid            uint64
+		prevOff, prevPos uint64
+	)
+	for i := uint64(0); i < s.index.size/uint64(entryWidth); i++ {
+		off, pos, err := s.index.Read(int64(i))
+		if err != nil {
+			return err
+		}
+		if i > 0 && (uint64(off) <= prevOff || pos <= prevPos) {
+			break
+		}
+		if pos >= s.store.size {
+			break
+		}
+		prevOff, prevPos = uint64(off), pos
+		valid++
+	}
+
+	// Drop trailing entries whose records didn't make it to disk whole.
+	var next uint64
+	s.nextOffset, s.indexedPos = s.baseOffset, 0
+	for ; valid > 0; valid-- {
+		off, pos, err := s.index.Read(int64(valid - 1))
+		if err != nil {
+			return err
+		}
+		p, _, err := s.store.readRaw(pos)
+		if err != nil {
+			continue
+		}
+		next = pos + headerWidth + uint64(len(p))
+		s.nextOffset = s.baseOffset + uint64(off) + 1
+		s.indexedPos = pos
+		break
+	}
+	s.index.size = valid * uint64(entryWidth)
+
+	return s.indexFrom(next)
+}
+
+// indexFrom walks the store from pos onwards and indexes the complete
+// records it finds, as sparsely as the config asks. The store is truncated
+// at the first torn or corrupt record since nothing after it can be
+// trusted. If the index fills up, the records after its last entry are
+// still kept, and found by scanning forward from it; the segment is maxed
+// then, so the log moves on to a new one.
+func (s *segment) indexFrom(pos uint64) error {
+	full := false
+	for pos < s.store.size {
+		raw, attributes, err := s.store.readRaw(pos)
+		if torn(err) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		// The record is intact, so failing to decrypt it means the key is
+		// missing. That's no reason to throw it away.
+		p, err := s.store.open(raw, attributes)
+		if err != nil {
+			return err
+		}
+		record, err := s.decode(p, attributes)
+		if err != nil || record.Offset < s.baseOffset {
+			break
+		}
+		if !full {
+			err = s.indexRecord(record.Offset, pos)
+			if err == io.EOF {
+				full = true
+			} else if err != nil {
+				return err
+			}
+		}
+		s.nextOffset = record.Offset + 1
+		pos += headerWidth + uint64(len(raw))
+	}
+
+	if pos < s.store.size {
+		return s.store.truncate(pos)
+	}
+	return nil
+}
+
+// torn reports whether err from reading a record means the record was
+// only partly written or is corrupt, rather than that reading failed.
+func torn(err error) bool {
+	if _, ok := err.(api.ErrCorruptRecord); ok {
+		return true
+	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// RebuildIndex discards the index of the segment with the given base
+// offset in dir and regenerates it by scanning the segment's store. Use it
+// to recover a segment whose index is corrupt; missing or short indexes
+// are rebuilt automatically when the log is opened.
+func RebuildIndex(dir string, baseOffset uint64, c Config) error {
+	storePath := path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store"))
+	if _, err := os.Stat(storePath); err != nil {
+		return err
+	}
+
+	indexPath := path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index"))
+	if err := os.Remove(indexPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	s, err := newSegment(dir, baseOffset, c.withDefaults())
+	if err != nil {
+		return err
+	}
+
+	return s.Close()
+}
+
+// repairTimeIndex trims the time index back to the entries that are in
+// order and point at records the segment still holds. If the time index
+// wasn't closed cleanly, or is missing, the records after its last entry
+// are read back so a lost entry can't hide them from offsetForTime.
+func (s *segment) repairTimeIndex() error {
+	onDisk := s.timeIndex.size
+
+	var (
+		valid   uint64
+		prevTs  int64
+		prevOff uint32
+	)
+	for i := uint64(0); i < s.timeIndex.size/uint64(timeEntryWidth); i++ {
+		ts, off, err := s.timeIndex.Read(int64(i))
+		if err != nil {
+			return err
+		}
+		if ts <= prevTs || (i > 0 && off <= prevOff) {
+			break
+		}
+		if s.baseOffset+uint64(off) >= s.nextOffset {
+			break
+		}
+		prevTs, prevOff = ts, off
+		valid++
+	}
+	s.timeIndex.size = valid * uint64(timeEntryWidth)
+	s.maxTimestamp = prevTs
+
+	// Close truncates the file to exactly its entries.
+	if valid > 0 && onDisk == s.timeIndex.size {
+		return nil
+	}
+
+	next := s.baseOffset
+	if valid > 0 {
+		next += uint64(prevOff) + 1
+	}
+	for off := next; off < s.nextOffset; {
+		record, err := s.Read(off)
+		if err != nil {
+			return err
+		}
+		// Compacted segments have gaps, so carry on from the record
+		// actually read rather than the offset asked for.
+		off = record.Offset + 1
+		if record.Timestamp <= s.maxTimestamp {
+			continue
+		}
+		err = s.timeIndex.Write(record.Timestamp, uint32(record.Offset-s.baseOffset))
+		if err == io.EOF {
+			// The time index is full. Lookups past its last entry fall
+			// through to the next segment.
+			break
+		}
+		if err != nil {
+			return err
+		}
+		s.maxTimestamp = record.Timestamp
+	}
+
+	return nil
+}
@@ -0,0 +1,71 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	api "github.com/hindenbug/dlog/api/log/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRebuildIndex(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "rebuild-index-test")
+	defer os.RemoveAll(dir)
+
+	record := &api.Record{Value: []byte("hello world")}
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err = s.Append(record)
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.Close())
+
+	// Point every entry at the wrong record. The offsets and positions
+	// still increase, so nothing short of a rebuild notices.
+	indexPath := path.Join(dir, "16.index")
+	b, err := ioutil.ReadFile(indexPath)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(indexPath, append(b[entryWidth:], b[:entryWidth]...), 0644))
+
+	require.NoError(t, RebuildIndex(dir, 16, c))
+
+	s, err = newSegment(dir, 16, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(19), s.nextOffset)
+	for off := uint64(16); off < 19; off++ {
+		res, err := s.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, res.Offset)
+	}
+	require.NoError(t, s.Close())
+
+	// Rebuilding applies the log's defaults to a zero config.
+	require.NoError(t, RebuildIndex(dir, 16, Config{}))
+
+	// An index too small for every record keeps all of them anyway.
+	small := c
+	small.Segment.MaxIndexBytes = uint64(entryWidth)
+	require.NoError(t, RebuildIndex(dir, 16, small))
+	s, err = newSegment(dir, 16, small)
+	require.NoError(t, err)
+	require.Equal(t, uint64(19), s.nextOffset)
+	require.Equal(t, uint64(entryWidth), s.index.size)
+	require.True(t, s.IsMaxed())
+	for off := uint64(16); off < 19; off++ {
+		res, err := s.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, res.Offset)
+	}
+	require.NoError(t, s.Close())
+
+	// There's nothing to rebuild from without a store.
+	require.Error(t, RebuildIndex(dir, 0, c))
+}
@@ -3,15 +3,29 @@ package log
 import (
 	"context"
 	"sync"
+	"time"
 
 	api "github.com/hindenbug/dlog/api/log/v1"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// defaultRefreshInterval is how often a Replicator looks for new topics
+// when its RefreshInterval isn't set.
+const defaultRefreshInterval = time.Second
+
+// Replicator copies the records of every server that joins the cluster into
+// the local server: every partition of every topic, each one into the same
+// topic and partition. Topics are created locally with the partition count
+// they have on the server they're copied from.
 type Replicator struct {
 	DialOptions []grpc.DialOption
 	LocalServer api.LogClient
+	// RefreshInterval is how often each server is asked for topics that
+	// aren't replicated yet. A second if zero.
+	RefreshInterval time.Duration
 
 	logger *zap.Logger
 
@@ -42,6 +56,11 @@ func (r *Replicator) Join(name, addr string) error {
 	return nil
 }
 
+// replicate copies the records of every topic and partition of the server
+// at addr into the same topic and partition of the local server, until the
+// server leaves or the replicator closes. It lists the server's topics every
+// RefreshInterval, creating the ones the local server doesn't have and
+// replicating any partitions it hasn't started on yet.
 func (r *Replicator) replicate(addr string, leave chan struct{}) {
 	cc, err := grpc.Dial(addr, r.DialOptions...)
 
@@ -53,10 +72,90 @@ func (r *Replicator) replicate(addr string, leave chan struct{}) {
 
 	client := api.NewLogClient(cc)
 
-	ctx := context.Background()
+	// Stop receiving as soon as the server leaves or the replicator closes.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-r.close:
+		case <-leave:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+
+	interval := r.RefreshInterval
+	if interval == 0 {
+		interval = defaultRefreshInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	// A partition is replicated from its first record, so one whose
+	// stream ended isn't started again: it would copy its records twice.
+	started := make(map[string]uint32)
+	for {
+		list, err := client.ListTopics(ctx, &api.ListTopicsRequest{})
+		if err != nil {
+			if ctx.Err() == nil {
+				r.logError(err, "failed to list topics", addr)
+			}
+		} else {
+			for i, topic := range list.Topics {
+				partitions := list.Partitions[i]
+				if started[topic] >= partitions {
+					continue
+				}
+				if err := r.createTopic(ctx, topic, partitions); err != nil {
+					r.logError(err, "failed to create topic", addr)
+					continue
+				}
+				for p := started[topic]; p < partitions; p++ {
+					wg.Add(1)
+					go func(topic string, partition uint32) {
+						defer wg.Done()
+						r.replicatePartition(ctx, client, addr, topic, partition)
+					}(topic, p)
+				}
+				started[topic] = partitions
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// createTopic creates the topic on the local server unless it's there
+// already.
+func (r *Replicator) createTopic(ctx context.Context, topic string, partitions uint32) error {
+	_, err := r.LocalServer.CreateTopic(ctx, &api.CreateTopicRequest{
+		Topic:      topic,
+		Partitions: partitions,
+	})
+	if status.Code(err) == codes.AlreadyExists {
+		return nil
+	}
+
+	return err
+}
+
+// replicatePartition copies the records of a partition of the server at
+// addr into the local server. The server's records are read with a
+// streamIterator, which walks a ConsumeStream the way an Iterator walks a
+// local log.
+func (r *Replicator) replicatePartition(ctx context.Context, client api.LogClient, addr, topic string, partition uint32) {
 	stream, err := client.ConsumeStream(ctx,
 		&api.ConsumeRequest{
-			Offset: 0,
+			Topic:     topic,
+			Offset:    0,
+			Partition: partition,
 		},
 	)
 
@@ -64,36 +163,28 @@ func (r *Replicator) replicate(addr string, leave chan struct{}) {
 		r.logError(err, "failed to consume", addr)
 		return
 	}
-	records := make(chan *api.Record)
-	go func() {
-		for {
-			recv, err := stream.Recv()
-			if err != nil {
-				r.logError(err, "failed to receive", addr)
-				return
-			}
-			records <- recv.Record
-		}
-	}()
 
-	for {
-		select {
-		case <-r.close:
-			return
-		case <-leave:
-			return
-		case record := <-records:
-			_, err = r.LocalServer.Produce(ctx,
-				&api.ProduceRequest{
-					Record: record,
-				},
-			)
-			if err != nil {
+	it := &streamIterator{stream: stream}
+	defer it.Close()
+
+	for it.Next() {
+		_, err = r.LocalServer.Produce(ctx,
+			&api.ProduceRequest{
+				Topic:     topic,
+				Record:    it.Record(),
+				Partition: &partition,
+			},
+		)
+		if err != nil {
+			if ctx.Err() == nil {
 				r.logError(err, "failed to produce", addr)
-				return
 			}
+			return
 		}
 	}
+	if ctx.Err() == nil {
+		r.logError(it.Err(), "failed to receive", addr)
+	}
 }
 
 func (r *Replicator) Leave(name string) error {
@@ -142,3 +233,51 @@ func (r *Replicator) logError(err error, msg, addr string) {
 		zap.Error(err),
 	)
 }
+
+// streamIterator walks the records a ConsumeStream receives, one batch at
+// a time when the server sends them in batches. Next blocks until the
+// server sends more, and returns false once the stream ends.
+type streamIterator struct {
+	stream  api.Log_ConsumeStreamClient
+	records []*api.Record
+	record  *api.Record
+	err     error
+	closed  bool
+}
+
+func (it *streamIterator) Next() bool {
+	if it.err != nil || it.closed {
+		return false
+	}
+
+	for len(it.records) == 0 {
+		res, err := it.stream.Recv()
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.records = res.Records
+		if len(it.records) == 0 && res.Record != nil {
+			it.records = []*api.Record{res.Record}
+		}
+	}
+	it.record, it.records = it.records[0], it.records[1:]
+
+	return true
+}
+
+func (it *streamIterator) Record() *api.Record {
+	return it.record
+}
+
+func (it *streamIterator) Err() error {
+	return it.err
+}
+
+// Close stops the iterator. The stream itself ends with its context.
+func (it *streamIterator) Close() error {
+	it.closed = true
+	it.records = nil
+
+	return nil
+}
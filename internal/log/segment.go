@@ -1,9 +1,15 @@
 package log
 
 import (
+	"bufio"
+	"container/list"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"os"
 	"path"
+	"sync"
+	"time"
 
 	api "github.com/hindenbug/dlog/api/log/v1"
 
@@ -11,90 +17,465 @@ import (
 )
 
 type segment struct {
+	dir                    string
 	store                  *store
 	index                  *index
+	timeIndex              *timeIndex
 	baseOffset, nextOffset uint64
-	config                 Config
+	// maxTimestamp is the largest record timestamp in the segment.
+	maxTimestamp int64
+	// indexedPos is the store position of the last indexed record.
+	indexedPos uint64
+	config     Config
+	// closed is set once the segment is closed for good, because it was
+	// removed, rewritten or its log closed, so iterators reading it know
+	// to look it up again.
+	closed bool
+	// The log closes inactive segments' files to stay under its open
+	// segment limit. closedSize holds the size of a segment whose files
+	// are closed, refs the number of readers keeping its files open, and
+	// lru its place in the log's list of open segments.
+	closedSize uint64
+	refs       int
+	lru        *list.Element
+	// archive is set once the segment was moved to the log's archiver.
+	// Its files are then only in the cache while they're open.
+	archive *archiveMarker
+	// fetched is set while an archived segment's files are in the cache,
+	// and fetchMu makes sure only one reader fetches them.
+	fetched bool
+	fetchMu sync.Mutex
+	// keys records which keys the segment's records are encrypted with.
+	keys *keySet
 }
 
 func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	s := &segment{
+		dir:        dir,
 		baseOffset: baseOffset,
 		config:     c,
+		keys:       &keySet{ids: make(map[uint32]bool)},
+	}
+
+	return s, s.open()
+}
+
+// loadSegment returns the segment with the given base offset without
+// opening its files, using metadata read from the ends of the files
+// instead. If they weren't closed cleanly, the segment is opened so it
+// gets repaired.
+func loadSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
+	s := &segment{
+		dir:        dir,
+		baseOffset: baseOffset,
+		config:     c,
+		keys:       &keySet{ids: make(map[uint32]bool)},
+	}
+
+	clean, err := s.loadMetadata()
+	if err != nil {
+		return nil, err
+	}
+	if !clean {
+		return s, s.open()
+	}
+
+	return s, nil
+}
+
+// loadMetadata sets the segment's next offset, max timestamp and size from
+// the last entries of its indexes, and reports whether the files look
+// like they were closed cleanly. Indexes that weren't are still at their
+// full mmapped size, and their last entries can't be trusted.
+func (s *segment) loadMetadata() (bool, error) {
+	var sizes [3]uint64
+	for i, ext := range []string{".store", ".index", ".timeindex"} {
+		fi, err := os.Stat(s.path(ext))
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		sizes[i] = uint64(fi.Size())
+	}
+	storeSize, indexSize, timeIndexSize := sizes[0], sizes[1], sizes[2]
+
+	max := s.config.Segment.MaxIndexBytes
+	if indexSize == max || indexSize%uint64(entryWidth) != 0 ||
+		timeIndexSize == max || timeIndexSize%uint64(timeEntryWidth) != 0 {
+		return false, nil
+	}
+	if indexSize == 0 || timeIndexSize == 0 {
+		return storeSize == 0 && indexSize == 0 && timeIndexSize == 0, nil
+	}
+
+	entry, err := readFileAt(s.path(".index"), indexSize-uint64(entryWidth), entryWidth)
+	if err != nil {
+		return false, err
+	}
+	off := binary.BigEndian.Uint32(entry[:offsetWidth])
+	pos := binary.BigEndian.Uint64(entry[offsetWidth:])
+
+	// The last record has to end exactly where the store does.
+	if pos+headerWidth > storeSize {
+		return false, nil
+	}
+	header, err := readFileAt(s.path(".store"), pos, headerWidth)
+	if err != nil {
+		return false, err
+	}
+	if end := pos + headerWidth + binary.BigEndian.Uint64(header[:limit]); end != storeSize {
+		// A sparse index doesn't point at the last record, so it has
+		// to be read to find the segment's last offset.
+		if end > storeSize {
+			return false, nil
+		}
+		last, err := s.lastOffset(end, storeSize)
+		if err != nil {
+			return false, nil
+		}
+		off = uint32(last - s.baseOffset)
+	}
+
+	entry, err = readFileAt(s.path(".timeindex"), timeIndexSize-uint64(timeEntryWidth), timeEntryWidth)
+	if err != nil {
+		return false, err
+	}
+
+	s.nextOffset = s.baseOffset + uint64(off) + 1
+	s.maxTimestamp = int64(binary.BigEndian.Uint64(entry[:timestampWidth]))
+	s.closedSize = storeSize + indexSize + timeIndexSize
+	return true, nil
+}
+
+// lastOffset reads the store's records from pos to its end, which must be
+// at size, and returns the offset of the last one.
+func (s *segment) lastOffset(pos, size uint64) (uint64, error) {
+	f, err := os.Open(s.path(".store"))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var (
+		r          = bufio.NewReader(io.NewSectionReader(f, int64(pos), int64(size-pos)))
+		raw        []byte
+		attributes byte
+	)
+	for pos < size {
+		if raw, attributes, err = readRecord(r, pos, size); err != nil {
+			return 0, err
+		}
+		pos += headerWidth + uint64(len(raw))
+	}
+
+	p, err := openPayload(s.config.Encryption.Keyring, raw, attributes)
+	if err != nil {
+		return 0, err
+	}
+	record, err := s.decode(p, attributes)
+	if err != nil {
+		return 0, err
+	}
+
+	return record.Offset, nil
+}
+
+// readFileAt reads n bytes at off from the named file.
+func readFileAt(name string, off uint64, n int) ([]byte, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b := make([]byte, n)
+	if _, err := f.ReadAt(b, int64(off)); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// open opens the segment's files, repairing them if the segment wasn't
+// closed cleanly. The files are opened through a scratch segment, since a
+// segment reopened for a reader is shared with others that look at its
+// next offset and max timestamp while it's opened.
+func (s *segment) open() error {
+	o := &segment{dir: s.dir, baseOffset: s.baseOffset, config: s.config, keys: s.keys}
+	if err := o.openFiles(); err != nil {
+		return err
+	}
+	s.store, s.index, s.timeIndex, s.indexedPos = o.store, o.index, o.timeIndex, o.indexedPos
+
+	// Repairing works the next offset out from the store, which doesn't
+	// know about records compaction removed from the segment's end.
+	if o.nextOffset > s.nextOffset {
+		s.nextOffset = o.nextOffset
+	}
+	if o.maxTimestamp > s.maxTimestamp {
+		s.maxTimestamp = o.maxTimestamp
+	}
+
+	return nil
+}
+
+func (s *segment) openFiles() error {
+	migrated, err := migrateStore(s.path(".store"))
+	if err != nil {
+		return err
+	}
+	if migrated {
+		// The indexes point into the old layout, so they're rebuilt.
+		for _, ext := range []string{".index", ".timeindex"} {
+			if err := os.Remove(s.path(ext)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
 	}
 
-	var err error
 	storeFile, err := os.OpenFile(
-		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store")),
+		s.path(".store"),
 		os.O_RDWR|os.O_CREATE|os.O_APPEND,
 		0644,
 	)
 
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	if s.store, err = newStore(storeFile); err != nil {
-		return nil, err
+		return err
+	}
+	s.store.keyring = s.config.Encryption.Keyring
+	s.store.keys = s.keys
+	// An empty store has no records whose keys need finding out.
+	if s.store.size == 0 {
+		s.keys.merge(newKeySet())
 	}
 
 	indexFile, err := os.OpenFile(
-		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")),
+		s.path(".index"),
 		os.O_RDWR|os.O_CREATE,
 		0644,
 	)
 
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	if s.index, err = newIndex(indexFile, c); err != nil {
-		return nil, err
+	if s.index, err = newIndex(indexFile, s.config); err != nil {
+		return err
 	}
 
-	if off, _, err := s.index.Read(-1); err != nil {
-		s.nextOffset = baseOffset
-	} else {
-		s.nextOffset = baseOffset + uint64(off) + 1
+	if err = s.repair(); err != nil {
+		return err
 	}
 
-	return s, nil
+	timeIndexFile, err := os.OpenFile(
+		s.path(".timeindex"),
+		os.O_RDWR|os.O_CREATE,
+		0644,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	if s.timeIndex, err = newTimeIndex(timeIndexFile, s.config); err != nil {
+		return err
+	}
+
+	return s.repairTimeIndex()
+}
+
+// path returns the path of the segment's file with the given extension.
+func (s *segment) path(ext string) string {
+	return path.Join(s.dir, s.name(ext))
+}
+
+// name returns the name of the segment's file with the given extension.
+func (s *segment) name(ext string) string {
+	return fmt.Sprintf("%d%s", s.baseOffset, ext)
 }
 
 func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 	curr := s.nextOffset
-	record.Offset = curr
+	if _, err = s.AppendBatch([]*api.Record{record}); err != nil {
+		return 0, err
+	}
 
-	p, err := proto.Marshal(record)
+	return curr, nil
+}
 
-	if err != nil {
-		return 0, err
+// AppendBatch appends records from the front of the batch until it runs
+// out or the segment is maxed, and returns how many it appended. The
+// records go to the store in a single write. Room is planned in both
+// indexes up front, since a sparse offset index can fill up after the time
+// index does: either one being full ends the batch. If it fails part way
+// through, the log truncates the segment back to where the batch began.
+func (s *segment) AppendBatch(records []*api.Record) (n int, err error) {
+	var (
+		ps   [][]byte
+		size = s.store.size
+	)
+	for i, record := range records {
+		// Plan for every record needing an entry in both indexes.
+		indexSize := s.index.size + uint64(i+1)*uint64(entryWidth)
+		timeIndexSize := s.timeIndex.size + uint64(i+1)*uint64(timeEntryWidth)
+		if uint64(len(s.index.mmap)) < indexSize ||
+			uint64(len(s.timeIndex.mmap)) < timeIndexSize {
+			break
+		}
+
+		record.Offset = s.nextOffset + uint64(i)
+		if record.Timestamp == 0 {
+			record.Timestamp = time.Now().UnixMilli()
+		}
+
+		p, err := proto.Marshal(record)
+		if err != nil {
+			return 0, err
+		}
+		if p, err = s.config.Compression.compress(p); err != nil {
+			return 0, err
+		}
+		ps = append(ps, p)
+
+		size += headerWidth + uint64(len(p))
+		if size >= s.config.Segment.MaxStoreBytes ||
+			indexSize >= s.config.Segment.MaxIndexBytes ||
+			timeIndexSize >= s.config.Segment.MaxIndexBytes {
+			break
+		}
+	}
+	if len(ps) == 0 {
+		return 0, io.EOF
 	}
 
-	_, pos, err := s.store.Append(p)
+	pos, err := s.store.AppendBatch(ps, byte(s.config.Compression))
 	if err != nil {
 		return 0, err
 	}
 
-	if err := s.index.Write(
-		uint32(s.nextOffset-uint64(s.baseOffset)),
-		pos,
-	); err != nil {
-		return 0, err
+	for i, record := range records[:len(ps)] {
+		if err := s.indexRecord(s.nextOffset, pos[i]); err != nil {
+			return i, err
+		}
+
+		if record.Timestamp > s.maxTimestamp {
+			if err := s.timeIndex.Write(
+				record.Timestamp,
+				uint32(s.nextOffset-uint64(s.baseOffset)),
+			); err != nil {
+				return i, err
+			}
+			s.maxTimestamp = record.Timestamp
+		}
+
+		s.nextOffset++
 	}
 
-	s.nextOffset++
+	return len(ps), nil
+}
 
-	return curr, nil
+// segmentMark is where a segment's files and offsets ended at some point.
+type segmentMark struct {
+	nextOffset, indexedPos              uint64
+	storeSize, indexSize, timeIndexSize uint64
+	maxTimestamp                        int64
+}
+
+// mark returns where the segment ends now, to truncate it back to.
+func (s *segment) mark() segmentMark {
+	return segmentMark{
+		nextOffset:    s.nextOffset,
+		indexedPos:    s.indexedPos,
+		storeSize:     s.store.size,
+		indexSize:     s.index.size,
+		timeIndexSize: s.timeIndex.size,
+		maxTimestamp:  s.maxTimestamp,
+	}
+}
+
+// truncate drops the records appended to the segment since the mark.
+func (s *segment) truncate(m segmentMark) error {
+	if err := s.store.truncate(m.storeSize); err != nil {
+		return err
+	}
+	s.index.size, s.timeIndex.size = m.indexSize, m.timeIndexSize
+	s.nextOffset, s.indexedPos = m.nextOffset, m.indexedPos
+	s.maxTimestamp = m.maxTimestamp
+
+	return nil
+}
+
+// indexRecord adds an index entry for the record at pos, unless the index
+// is sparse and the last entry is too close to it.
+func (s *segment) indexRecord(offset, pos uint64) error {
+	if s.index.size > 0 && pos-s.indexedPos < s.config.Segment.IndexIntervalBytes {
+		return nil
+	}
+	if err := s.index.Write(uint32(offset-s.baseOffset), pos); err != nil {
+		return err
+	}
+	s.indexedPos = pos
+
+	return nil
 }
 
+// locate returns the store position to scan forward from to find the
+// record at the given offset: that of the closest index entry before it.
+func (s *segment) locate(offset uint64) (uint64, error) {
+	_, pos, err := s.index.Floor(uint32(offset - s.baseOffset))
+	if err == io.EOF {
+		return 0, nil
+	}
+
+	return pos, err
+}
+
+// Read returns the record at the given offset. If compaction removed that
+// record, the next record the segment still holds is returned instead; its
+// Offset field tells the caller where it really sits.
 func (s *segment) Read(offset uint64) (*api.Record, error) {
-	_, pos, err := s.index.Read(int64(offset - s.baseOffset))
+	pos, err := s.locate(offset)
 	if err != nil {
 		return nil, err
 	}
 
-	p, err := s.store.Read(pos)
+	for pos < s.store.size {
+		raw, attributes, err := s.store.readRaw(pos)
+		if corrupt, ok := err.(api.ErrCorruptRecord); ok {
+			corrupt.Offset = offset
+			return nil, corrupt
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		p, err := s.store.open(raw, attributes)
+		if err != nil {
+			return nil, err
+		}
+		record, err := s.decode(p, attributes)
+		if err != nil {
+			return nil, err
+		}
+		if record.Offset >= offset {
+			return record, nil
+		}
+		pos += headerWidth + uint64(len(raw))
+	}
+
+	return nil, io.EOF
+}
+
+// decode turns a payload read from the store back into a record,
+// decompressing it with the codec recorded in its attributes.
+func (s *segment) decode(p []byte, attributes byte) (*api.Record, error) {
+	p, err := Codec(attributes & codecMask).decompress(p)
 	if err != nil {
 		return nil, err
 	}
@@ -105,9 +486,41 @@ func (s *segment) Read(offset uint64) (*api.Record, error) {
 	return record, err
 }
 
+// offsetForTime returns the offset of the first record in the segment
+// whose timestamp is at or after the given one, or io.EOF if there's none.
+func (s *segment) offsetForTime(timestamp int64) (uint64, error) {
+	off, err := s.timeIndex.Lookup(timestamp)
+	if err != nil {
+		return 0, err
+	}
+
+	return s.baseOffset + uint64(off), nil
+}
+
 func (s *segment) IsMaxed() bool {
 	return s.store.size >= s.config.Segment.MaxStoreBytes ||
-		s.index.size >= s.config.Segment.MaxIndexBytes
+		s.index.size >= s.config.Segment.MaxIndexBytes ||
+		s.timeIndex.size >= s.config.Segment.MaxIndexBytes
+}
+
+// size returns the number of bytes the segment's store and indexes take up.
+func (s *segment) size() uint64 {
+	if s.store == nil {
+		return s.closedSize
+	}
+	return s.store.size + s.index.size + s.timeIndex.size
+}
+
+// modTime returns the last time a record was written to the segment's store.
+func (s *segment) modTime() (time.Time, error) {
+	if s.archive != nil {
+		return s.archive.ModTime, nil
+	}
+	fi, err := os.Stat(s.path(".store"))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
 }
 
 func (s *segment) Remove() error {
@@ -115,23 +528,50 @@ func (s *segment) Remove() error {
 		return err
 	}
 
-	if err := os.Remove(s.index.Name()); err != nil {
-		return err
+	if s.archive != nil {
+		return s.removeArchived()
 	}
+	return s.removeFiles()
+}
 
-	if err := os.Remove(s.store.Name()); err != nil {
-		return err
+// removeFiles removes the segment's files, if they exist.
+func (s *segment) removeFiles() error {
+	for _, ext := range []string{".index", ".timeindex", ".store"} {
+		if err := os.Remove(s.path(ext)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
 	}
 	return nil
 }
 
 func (s *segment) Close() error {
+	s.closed = true
+	return s.closeFiles()
+}
+
+// closeFiles closes the segment's files, which open can reopen later.
+func (s *segment) closeFiles() error {
+	if s.store == nil {
+		return nil
+	}
+	s.closedSize = s.size()
+
 	if err := s.index.Close(); err != nil {
 		return err
 	}
 
+	if err := s.timeIndex.Close(); err != nil {
+		return err
+	}
+
 	if err := s.store.Close(); err != nil {
 		return err
 	}
+
+	s.store, s.index, s.timeIndex = nil, nil, nil
+	if s.archive != nil {
+		s.fetched = false
+		return s.removeFiles()
+	}
 	return nil
 }
@@ -1,14 +1,20 @@
 package log
 
 import (
+	"encoding/binary"
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"testing"
 
 	api "github.com/hindenbug/dlog/api/log/v1"
 
 	"github.com/stretchr/testify/require"
+	"github.com/tysontate/gommap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestSegment(t *testing.T) {
@@ -50,6 +56,17 @@ func TestSegment(t *testing.T) {
 	// maxed store
 	require.True(t, s.IsMaxed())
 
+	// A damaged record is reported with its offset.
+	f, err := os.OpenFile(s.store.Name(), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("j"), headerWidth)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	_, err = s.Read(16)
+	require.Equal(t, api.ErrCorruptRecord{Offset: 16, Pos: 0}, err)
+	require.Equal(t, codes.DataLoss, status.Code(err))
+
 	err = s.Remove()
 	require.NoError(t, err)
 
@@ -57,3 +74,84 @@ func TestSegment(t *testing.T) {
 	require.NoError(t, err)
 	require.False(t, s.IsMaxed())
 }
+
+func TestSegmentRepair(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment-repair-test")
+	defer os.RemoveAll(dir)
+
+	record := &api.Record{Value: []byte("hello world")}
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err = s.Append(record)
+		require.NoError(t, err)
+	}
+	storeSize := s.store.size
+
+	// Simulate a crash: the last index entry never made it to disk, the
+	// index isn't truncated back from MaxIndexBytes and the store ends
+	// with half a record.
+	copy(s.index.mmap[entryWidth*2:entryWidth*3], make([]byte, entryWidth))
+	require.NoError(t, s.index.mmap.Sync(gommap.MS_SYNC))
+	require.NoError(t, s.index.file.Close())
+	_, err = s.store.buffer.Write([]byte{0, 0, 0, 0, 0, 0, 0, 42, 1})
+	require.NoError(t, err)
+	require.NoError(t, s.store.Close())
+
+	s, err = newSegment(dir, 16, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(19), s.nextOffset)
+	require.Equal(t, storeSize, s.store.size)
+
+	for off := uint64(16); off < 19; off++ {
+		res, err := s.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, res.Offset)
+	}
+
+	off, err := s.Append(record)
+	require.NoError(t, err)
+	require.Equal(t, uint64(19), off)
+	require.NoError(t, s.Close())
+}
+
+func TestSegmentLegacyStore(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment-legacy-test")
+	defer os.RemoveAll(dir)
+
+	// A store and index written before the versioned header: each record
+	// is prefixed by its length alone, and the index points at them.
+	var store, index []byte
+	for i := 0; i < 3; i++ {
+		p, err := proto.Marshal(&api.Record{Value: []byte("hello world"), Offset: uint64(16 + i)})
+		require.NoError(t, err)
+		entry := make([]byte, entryWidth)
+		binary.BigEndian.PutUint32(entry[:offsetWidth], uint32(i))
+		binary.BigEndian.PutUint64(entry[offsetWidth:], uint64(len(store)))
+		index = append(index, entry...)
+		length := make([]byte, limit)
+		binary.BigEndian.PutUint64(length, uint64(len(p)))
+		store = append(store, append(length, p...)...)
+	}
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "16.store"), store, 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "16.index"), index, 0644))
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	defer s.Close()
+
+	require.Equal(t, uint64(19), s.nextOffset)
+	for off := uint64(16); off < 19; off++ {
+		record, err := s.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, record.Offset)
+	}
+}
@@ -0,0 +1,257 @@
+package log
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+// manifestName is the name of the first entry in a snapshot.
+const manifestName = "manifest.json"
+
+// manifest describes the segments in a snapshot and the config the log
+// was written with.
+type manifest struct {
+	Config   Config
+	Segments []manifestSegment
+}
+
+type manifestSegment struct {
+	BaseOffset     uint64
+	NextOffset     uint64
+	StoreBytes     uint64
+	IndexBytes     uint64
+	TimeIndexBytes uint64
+}
+
+// Snapshot writes a tar archive of the log to w: a manifest followed by
+// every segment's store and index files, oldest first. The log is only
+// locked while the snapshot records its segments and opens their files.
+// Appends, retention and compaction carry on while the files are copied:
+// appends only add to them, and files that are removed or replaced stay
+// readable until the snapshot closes them. Records stay compressed and
+// encrypted just as they are on disk.
+func (l *Log) Snapshot(w io.Writer) error {
+	var (
+		m     manifest
+		files []pinnedFile
+	)
+	err := l.fetching(func() (err error) {
+		m, files, err = l.pin()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer closePinned(files)
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	tw := tar.NewWriter(w)
+	if err = tw.WriteHeader(&tar.Header{
+		Name:    manifestName,
+		Mode:    0644,
+		Size:    int64(len(b)),
+		ModTime: now,
+	}); err != nil {
+		return err
+	}
+	if _, err = tw.Write(b); err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if err = f.write(tw, now); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+// pinnedFile is a segment file opened so it can be read without holding
+// l.mu, and how many of its bytes belong to the segment as it was then.
+type pinnedFile struct {
+	*os.File
+	size uint64
+}
+
+func closePinned(files []pinnedFile) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// pin returns the manifest of the log's segments as they are now, and
+// their files opened so they can be copied without holding l.mu.
+func (l *Log) pin() (manifest, []pinnedFile, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	m := manifest{Config: l.Config}
+	var files []pinnedFile
+	for _, s := range l.segments {
+		ms, fs, err := l.pinSegment(s)
+		if err != nil {
+			closePinned(files)
+			return m, nil, err
+		}
+		files = append(files, fs...)
+		m.Segments = append(m.Segments, ms)
+	}
+
+	return m, files, nil
+}
+
+// pinSegment describes the segment for a manifest and opens its files. It
+// must be called with l.mu held. Open segments' indexes are longer than
+// their entries, so only as many bytes as the manifest records belong to
+// the segment.
+func (l *Log) pinSegment(s *segment) (manifestSegment, []pinnedFile, error) {
+	ms := manifestSegment{BaseOffset: s.baseOffset}
+	if err := l.acquire(s); err != nil {
+		return ms, nil, err
+	}
+	defer l.release(s)
+
+	if err := s.store.Flush(); err != nil {
+		return ms, nil, err
+	}
+	ms.NextOffset = s.nextOffset
+	ms.StoreBytes = s.store.size
+	ms.IndexBytes = s.index.size
+	ms.TimeIndexBytes = s.timeIndex.size
+
+	var files []pinnedFile
+	sizes := []uint64{ms.StoreBytes, ms.IndexBytes, ms.TimeIndexBytes}
+	for i, ext := range []string{".store", ".index", ".timeindex"} {
+		f, err := os.Open(s.path(ext))
+		if err != nil {
+			closePinned(files)
+			return ms, nil, err
+		}
+		files = append(files, pinnedFile{f, sizes[i]})
+	}
+
+	return ms, files, nil
+}
+
+// write adds the first size bytes of the file to tw.
+func (f pinnedFile) write(tw *tar.Writer, modTime time.Time) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    path.Base(f.Name()),
+		Mode:    0644,
+		Size:    int64(f.size),
+		ModTime: modTime,
+	}); err != nil {
+		return err
+	}
+
+	_, err := io.CopyN(tw, f, int64(f.size))
+	return err
+}
+
+// Restore writes the log in the snapshot read from r to dir, which must be
+// empty or not exist yet, and returns the config the log was written with.
+// Open the restored log with NewLog and that config, after setting the
+// keyring again if the log is encrypted. If the snapshot turns out to be
+// incomplete or malformed, nothing is left behind in dir.
+func Restore(dir string, r io.Reader) (c Config, err error) {
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return c, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return c, err
+	}
+	if len(files) > 0 {
+		return c, fmt.Errorf("restore directory isn't empty: %s", dir)
+	}
+
+	var written []string
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, name := range written {
+			os.Remove(name)
+		}
+	}()
+
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil {
+		return c, err
+	}
+	if hdr.Name != manifestName {
+		return c, fmt.Errorf("snapshot doesn't start with a manifest")
+	}
+	var m manifest
+	if err = json.NewDecoder(tr).Decode(&m); err != nil {
+		return c, err
+	}
+
+	// Only the files the manifest lists are restored, each exactly once.
+	sizes := make(map[string]uint64)
+	for _, ms := range m.Segments {
+		s := &segment{baseOffset: ms.BaseOffset}
+		sizes[s.path(".store")] = ms.StoreBytes
+		sizes[s.path(".index")] = ms.IndexBytes
+		sizes[s.path(".timeindex")] = ms.TimeIndexBytes
+	}
+
+	for {
+		hdr, err = tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return c, err
+		}
+
+		size, ok := sizes[hdr.Name]
+		if !ok {
+			return c, fmt.Errorf("unexpected file in snapshot: %s", hdr.Name)
+		}
+		if uint64(hdr.Size) != size {
+			return c, fmt.Errorf("%s is %d bytes, the manifest says %d", hdr.Name, hdr.Size, size)
+		}
+		delete(sizes, hdr.Name)
+
+		name := path.Join(dir, hdr.Name)
+		written = append(written, name)
+		if err = restoreFile(name, tr); err != nil {
+			return c, err
+		}
+	}
+	for name := range sizes {
+		return c, fmt.Errorf("file missing from snapshot: %s", name)
+	}
+
+	return m.Config, nil
+}
+
+// restoreFile writes the contents of r to a new file with the given name
+// and syncs it.
+func restoreFile(name string, r io.Reader) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err = io.Copy(f, r); err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
@@ -0,0 +1,143 @@
+package log
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	api "github.com/hindenbug/dlog/api/log/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 100
+	c.Compression = Snappy
+	require.NoError(t, os.Mkdir(path.Join(dir, "log"), 0755))
+	log, err := NewLog(path.Join(dir, "log"), c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(log.segments), 1)
+
+	var b bytes.Buffer
+	require.NoError(t, log.Snapshot(&b))
+
+	restored := path.Join(dir, "restored")
+	rc, err := Restore(restored, bytes.NewReader(b.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, log.Config.Segment, rc.Segment)
+	require.Equal(t, c.Compression, rc.Compression)
+
+	// The restored log picks up where the original was snapshotted.
+	rlog, err := NewLog(restored, rc)
+	require.NoError(t, err)
+	defer rlog.Close()
+
+	for off := uint64(0); off < 5; off++ {
+		read, err := rlog.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, read.Offset)
+		require.Equal(t, []byte("hello world"), read.Value)
+	}
+	off, err := rlog.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+
+	// Restoring over an existing log is refused.
+	_, err = Restore(restored, bytes.NewReader(b.Bytes()))
+	require.Error(t, err)
+
+	// A snapshot that's cut short leaves nothing behind.
+	truncated := path.Join(dir, "truncated")
+	_, err = Restore(truncated, bytes.NewReader(b.Bytes()[:b.Len()/2]))
+	require.Error(t, err)
+	files, err := ioutil.ReadDir(truncated)
+	require.NoError(t, err)
+	require.Empty(t, files)
+}
+
+// blockingWriter holds up the first Write until release is closed.
+type blockingWriter struct {
+	bytes.Buffer
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	select {
+	case w.writing <- struct{}{}:
+		<-w.release
+	default:
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestSnapshotConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot-concurrent-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 100
+	require.NoError(t, os.Mkdir(path.Join(dir, "log"), 0755))
+	log, err := NewLog(path.Join(dir, "log"), c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	w := &blockingWriter{
+		writing: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+	errc := make(chan error)
+	go func() {
+		errc <- log.Snapshot(w)
+	}()
+	<-w.writing
+
+	// Appends and retention don't wait for the snapshot, nor change it.
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello again")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Truncate(4))
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Greater(t, lowest, uint64(0))
+
+	close(w.release)
+	require.NoError(t, <-errc)
+
+	restored := path.Join(dir, "restored")
+	rc, err := Restore(restored, bytes.NewReader(w.Bytes()))
+	require.NoError(t, err)
+	rlog, err := NewLog(restored, rc)
+	require.NoError(t, err)
+	defer rlog.Close()
+
+	for off := uint64(0); off < 5; off++ {
+		read, err := rlog.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, read.Offset)
+		require.Equal(t, []byte("hello world"), read.Value)
+	}
+	highest, err := rlog.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), highest)
+}
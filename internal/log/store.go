@@ -3,15 +3,51 @@ package log
 import (
 	"bufio"
 	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
 	"sync"
+
+	api "github.com/hindenbug/dlog/api/log/v1"
 )
 
+// Every record in the store is prefixed with a fixed-size header:
+//
+//	length (8) | version (1) | attributes (1) | crc (4) | payload (length)
+//
+// The crc is a CRC32C checksum of the payload, which lets reads detect bit
+// flips and torn writes instead of handing garbage to the caller. The
+// attributes byte holds per-record flags: the lowest three bits name the
+// codec the payload was compressed with, and encryptedFlag is set when the
+// payload is encrypted. The crc covers the payload as stored.
+//
+// Stores written before the header existed hold records prefixed by their
+// length alone, version 0 of the format. They're told apart by the byte
+// where the first header's version goes: in a version 0 store it's the
+// first byte of a protobuf payload, which is at least 8, or the top byte
+// of the next record's length, which is 0. Version 0 stores are migrated
+// to the current format by migrateStore when their segment is opened.
 const (
 	// limit determines how many bytes will be used to store the length of the record.
 	limit = 8
+
+	versionWidth    = 1
+	attributesWidth = 1
+	crcWidth        = 4
+	headerWidth     = limit + versionWidth + attributesWidth + crcWidth
+
+	// recordVersion is the header version written by this store.
+	recordVersion = 1
+	// legacyMarker is the lowest value the byte after the first length can
+	// have in a version 0 store, other than 0.
+	legacyMarker = 8
+
+	encryptedFlag = 0x08
 )
 
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
 type store struct {
 	// type embedding of an os file.
 	*os.File
@@ -19,6 +55,12 @@ type store struct {
 	mu     sync.Mutex
 	buffer *bufio.Writer
 	size   uint64
+	// synced is the size the store had when it was last fsynced.
+	synced uint64
+	// keyring, if set, encrypts the records appended to the store.
+	keyring *Keyring
+	// keys, if set, records the keys of the records appended to the store.
+	keys *keySet
 }
 
 func newStore(f *os.File) (*store, error) {
@@ -29,57 +71,234 @@ func newStore(f *os.File) (*store, error) {
 	}
 
 	size := uint64(file.Size())
-	return &store{File: f, size: size, buffer: bufio.NewWriter(f)}, nil
+	return &store{File: f, size: size, synced: size, buffer: bufio.NewWriter(f)}, nil
 
 }
 
+// migrateStore rewrites the store at path in the current format if it's
+// in version 0 of it, and reports whether it did. Version 0 records are
+// neither compressed nor encrypted. A torn record at the end is dropped,
+// as recovery would drop it.
+func migrateStore(path string) (bool, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	size := uint64(fi.Size())
+	if size <= limit {
+		return false, nil
+	}
+
+	version := make([]byte, versionWidth)
+	if _, err = f.ReadAt(version, limit); err != nil {
+		return false, err
+	}
+	switch {
+	case version[0] == recordVersion:
+		return false, nil
+	case version[0] != 0 && version[0] < legacyMarker:
+		return false, fmt.Errorf("%s: unknown record version %d", path, version[0])
+	}
+
+	tmp, err := os.Create(path + ".migrate")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	r := bufio.NewReader(f)
+	w := bufio.NewWriter(tmp)
+	header := make([]byte, headerWidth)
+	for pos := uint64(0); pos+limit <= size; {
+		if _, err := io.ReadFull(r, header[:limit]); err != nil {
+			return false, err
+		}
+		length := binary.BigEndian.Uint64(header[:limit])
+		if pos+limit+length > size {
+			break
+		}
+		p := make([]byte, length)
+		if _, err := io.ReadFull(r, p); err != nil {
+			return false, err
+		}
+		putHeader(header, p, 0)
+		if _, err := w.Write(header); err != nil {
+			return false, err
+		}
+		if _, err := w.Write(p); err != nil {
+			return false, err
+		}
+		pos += limit + length
+	}
+
+	if err := w.Flush(); err != nil {
+		return false, err
+	}
+	if err := tmp.Sync(); err != nil {
+		return false, err
+	}
+
+	return true, os.Rename(tmp.Name(), path)
+}
+
 // Append writes the provided bytes as a record to the end of the store.
 // Returns the size fo the record and the position of the record within the store.
 func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	pos = s.size
 
-	// write the binary representation of the data into the bufio.Writer
-	// we first tell how much data we're going to write, with what encoding format
-	if err := binary.Write(s.buffer, binary.BigEndian, uint64(len(p))); err != nil {
+	positions, err := s.append([][]byte{p}, 0)
+	if err != nil {
 		return 0, 0, err
 	}
 
-	// Write the Record data
-	w, err := s.buffer.Write(p)
-	if err != nil {
-		return 0, 0, err
+	return s.size - positions[0], positions[0], nil
+}
+
+// AppendBatch writes the provided payloads as consecutive records with the
+// given attributes in a single write, and returns the position of each one
+// within the store.
+func (s *store) AppendBatch(ps [][]byte, attributes byte) (pos []uint64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.append(ps, attributes)
+}
+
+func (s *store) append(ps [][]byte, attributes byte) (pos []uint64, err error) {
+	if s.keyring != nil {
+		attributes |= encryptedFlag
+		sealed := make([][]byte, len(ps))
+		for i, p := range ps {
+			if sealed[i], err = s.keyring.seal(p); err != nil {
+				return nil, err
+			}
+		}
+		ps = sealed
+	}
+
+	var size int
+	for _, p := range ps {
+		size += headerWidth + len(p)
+	}
+
+	// Each record's header goes ahead of its payload. It tells how much
+	// data follows and lets readers verify it once it's read back.
+	b := make([]byte, 0, size)
+	pos = make([]uint64, len(ps))
+	for i, p := range ps {
+		pos[i] = s.size + uint64(len(b))
+		header := b[len(b) : len(b)+headerWidth]
+		putHeader(header, p, attributes)
+		b = append(b[:len(b)+headerWidth], p...)
+	}
+
+	if _, err := s.buffer.Write(b); err != nil {
+		return nil, err
+	}
+	s.size += uint64(len(b))
+	if s.keys != nil {
+		for _, p := range ps {
+			s.keys.add(p, attributes)
+		}
 	}
 
-	// The number of written bytes is the Record length + the written Record data size
-	w += limit
-	s.size += uint64(w)
+	return pos, nil
+}
 
-	return uint64(w), pos, nil
+// putHeader encodes the header for the payload p into header.
+func putHeader(header, p []byte, attributes byte) {
+	binary.BigEndian.PutUint64(header[:limit], uint64(len(p)))
+	header[limit] = recordVersion
+	header[limit+versionWidth] = attributes
+	binary.BigEndian.PutUint32(header[headerWidth-crcWidth:], crc32.Checksum(p, crcTable))
 }
 
 func (s *store) Read(pos uint64) ([]byte, error) {
+	p, _, err := s.ReadRecord(pos)
+	return p, err
+}
+
+// ReadRecord reads the record at pos like Read, and also returns the
+// attributes from its header.
+func (s *store) ReadRecord(pos uint64) (p []byte, attributes byte, err error) {
+	if p, attributes, err = s.readRaw(pos); err != nil {
+		return nil, 0, err
+	}
+
+	p, err = s.open(p, attributes)
+	return p, attributes, err
+}
+
+// readRaw reads the record at pos as it's stored, without decrypting it.
+func (s *store) readRaw(pos uint64) (p []byte, attributes byte, err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	// flush the buffered writer so we don't read a record that hasn't been flushed to disk yet
 	if err := s.buffer.Flush(); err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	// The amount of bytes needed to read the whole record are determined
-	size := make([]byte, limit)
-	if _, err := s.File.ReadAt(size, int64(pos)); err != nil {
-		return nil, err
+	if pos >= s.size {
+		return nil, 0, io.EOF
 	}
 
-	// Read the actual record data given its offset and size.
-	b := make([]byte, binary.BigEndian.Uint64(size))
-	if _, err := s.File.ReadAt(b, int64(pos+limit)); err != nil {
-		return nil, err
+	return readRecord(io.NewSectionReader(s.File, int64(pos), int64(s.size-pos)), pos, s.size)
+}
+
+// readRecord reads the record at pos in a store of the given size from r,
+// which must be positioned at the record, and checks it against its header.
+func readRecord(r io.Reader, pos, size uint64) (p []byte, attributes byte, err error) {
+	// The header tells how many bytes are needed to read the whole record.
+	header := make([]byte, headerWidth)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, 0, err
+	}
+
+	length := binary.BigEndian.Uint64(header[:limit])
+	if header[limit] != recordVersion || pos+headerWidth+length > size {
+		return nil, 0, api.ErrCorruptRecord{Pos: pos}
+	}
+
+	// Read the actual record data given its size.
+	b := make([]byte, length)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, 0, err
+	}
+
+	if crc32.Checksum(b, crcTable) != binary.BigEndian.Uint32(header[headerWidth-crcWidth:]) {
+		return nil, 0, api.ErrCorruptRecord{Pos: pos}
 	}
 
-	return b, nil
+	return b, header[limit+versionWidth], nil
+}
+
+// open decrypts the payload if its attributes say it's encrypted.
+func (s *store) open(p []byte, attributes byte) ([]byte, error) {
+	return openPayload(s.keyring, p, attributes)
+}
+
+// openPayload decrypts the payload with the keyring if its attributes say
+// it's encrypted.
+func openPayload(k *Keyring, p []byte, attributes byte) ([]byte, error) {
+	if attributes&encryptedFlag == 0 {
+		return p, nil
+	}
+	if k == nil {
+		return nil, errNoKeyring
+	}
+
+	return k.open(p)
 }
 
 func (s *store) ReadAt(p []byte, offset int64) (int, error) {
@@ -92,6 +311,53 @@ func (s *store) ReadAt(p []byte, offset int64) (int, error) {
 	return s.File.ReadAt(p, offset)
 }
 
+// Flush hands the buffered records to the operating system.
+func (s *store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.buffer.Flush()
+}
+
+// Sync flushes the buffered records and fsyncs the file, unless nothing
+// was appended since the last sync.
+func (s *store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.synced == s.size {
+		return nil
+	}
+
+	if err := s.buffer.Flush(); err != nil {
+		return err
+	}
+	if err := s.File.Sync(); err != nil {
+		return err
+	}
+	s.synced = s.size
+
+	return nil
+}
+
+// truncate drops everything in the store from size onwards.
+func (s *store) truncate(size uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buffer.Flush(); err != nil {
+		return err
+	}
+
+	if err := s.File.Truncate(int64(size)); err != nil {
+		return err
+	}
+	s.size = size
+	if s.synced > size {
+		s.synced = size
+	}
+
+	return nil
+}
+
 func (s *store) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
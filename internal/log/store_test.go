@@ -6,12 +6,14 @@ import (
 	"os"
 	"testing"
 
+	api "github.com/hindenbug/dlog/api/log/v1"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
 )
 
 var (
 	testData = []byte("hello world")
-	width    = limit + uint64(len(testData))
+	width    = headerWidth + uint64(len(testData))
 )
 
 func TestStoreAppendRead(t *testing.T) {
@@ -55,13 +57,13 @@ func testRead(t *testing.T, s *store) {
 func testReadAt(t *testing.T, s *store) {
 	t.Helper()
 	for i, offset := uint64(1), int64(0); i < 4; i++ {
-		b := make([]byte, limit)
+		b := make([]byte, headerWidth)
 		n, err := s.ReadAt(b, offset)
 		require.NoError(t, err)
-		require.Equal(t, limit, n)
+		require.Equal(t, headerWidth, n)
 		offset += int64(n)
 
-		size := binary.BigEndian.Uint64(b)
+		size := binary.BigEndian.Uint64(b[:limit])
 		b = make([]byte, size)
 		n, err = s.ReadAt(b, offset)
 		require.NoError(t, err)
@@ -71,6 +73,73 @@ func testReadAt(t *testing.T, s *store) {
 	}
 }
 
+func TestStoreCorruption(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_corruption_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+
+	_, pos, err := s.Append(testData)
+	require.NoError(t, err)
+	_, err = s.Read(pos)
+	require.NoError(t, err)
+
+	// Flip a bit in the payload behind the store's back.
+	corrupt, err := os.OpenFile(f.Name(), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	_, err = corrupt.WriteAt([]byte{testData[0] ^ 1}, int64(pos+headerWidth))
+	require.NoError(t, err)
+	require.NoError(t, corrupt.Close())
+
+	_, err = s.Read(pos)
+	require.Equal(t, api.ErrCorruptRecord{Pos: pos}, err)
+}
+
+func TestStoreLegacyFormat(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_legacy_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	// Records as stores wrote them before the versioned header: their
+	// length followed by the protobuf-encoded record. The first one is
+	// empty, so the byte after its length is the top byte of the next.
+	var legacy []byte
+	for _, record := range []*api.Record{{}, {Value: testData}} {
+		p, err := proto.Marshal(record)
+		require.NoError(t, err)
+		length := make([]byte, limit)
+		binary.BigEndian.PutUint64(length, uint64(len(p)))
+		legacy = append(legacy, append(length, p...)...)
+	}
+	_, err = f.Write(legacy)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	migrated, err := migrateStore(f.Name())
+	require.NoError(t, err)
+	require.True(t, migrated)
+	migrated, err = migrateStore(f.Name())
+	require.NoError(t, err)
+	require.False(t, migrated)
+
+	f, err = os.OpenFile(f.Name(), os.O_RDWR|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	s, err := newStore(f)
+	require.NoError(t, err)
+	defer s.Close()
+
+	p, err := s.Read(0)
+	require.NoError(t, err)
+	require.Empty(t, p)
+	p, err = s.Read(headerWidth)
+	require.NoError(t, err)
+	record := &api.Record{}
+	require.NoError(t, proto.Unmarshal(p, record))
+	require.Equal(t, testData, record.Value)
+}
+
 func TestStoreClose(t *testing.T) {
 	f, err := ioutil.TempFile("", "store_close_test")
 	require.NoError(t, err)
@@ -0,0 +1,131 @@
+package log
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/tysontate/gommap"
+)
+
+// Time index entries pair the largest timestamp seen in the segment so far
+// with the relative offset of the record that carried it. An entry is only
+// written when a record moves the segment's max timestamp forward, so both
+// fields only ever increase and the index stays sparse: at most one entry
+// per millisecond, however many records land in it.
+var (
+	timestampWidth = 8
+	timeEntryWidth = timestampWidth + offsetWidth
+)
+
+type timeIndex struct {
+	file *os.File
+	mmap gommap.MMap
+	size uint64
+}
+
+// newTimeIndex sets up a time index the same way newIndex sets up an
+// offset index: the file grows to the max index size and is memory-mapped.
+// A segment is maxed once either index is full, since a sparse offset
+// index can end up with fewer entries than the time index.
+func newTimeIndex(f *os.File, c Config) (*timeIndex, error) {
+	idx := &timeIndex{
+		file: f,
+	}
+
+	file, err := os.Stat(f.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	idx.size = uint64(file.Size())
+	// An index written with a larger MaxIndexBytes keeps its entries.
+	max := c.Segment.MaxIndexBytes
+	if idx.size > max {
+		max = idx.size
+	}
+	if err := os.Truncate(f.Name(), int64(max)); err != nil {
+		return nil, err
+	}
+
+	if idx.mmap, err = gommap.Map(
+		idx.file.Fd(), gommap.PROT_READ|gommap.PROT_WRITE,
+		gommap.MAP_SHARED); err != nil {
+		return nil, err
+	}
+
+	return idx, nil
+}
+
+// Read returns the entry at the given position in the index, or the last
+// entry if in is -1.
+func (i *timeIndex) Read(in int64) (timestamp int64, offset uint32, err error) {
+	if i.size == 0 {
+		return 0, 0, io.EOF
+	}
+
+	if in == -1 {
+		in = int64(i.size/uint64(timeEntryWidth)) - 1
+	}
+
+	pos := uint64(in) * uint64(timeEntryWidth)
+	if i.size < pos+uint64(timeEntryWidth) {
+		return 0, 0, io.EOF
+	}
+
+	timestamp = int64(binary.BigEndian.Uint64(i.mmap[pos : pos+uint64(timestampWidth)]))
+	offset = binary.BigEndian.Uint32(i.mmap[pos+uint64(timestampWidth) : pos+uint64(timeEntryWidth)])
+
+	return timestamp, offset, nil
+}
+
+// Lookup returns the relative offset of the first entry whose timestamp is
+// at or after the given one, or io.EOF if every entry is older.
+func (i *timeIndex) Lookup(timestamp int64) (uint32, error) {
+	n := int(i.size / uint64(timeEntryWidth))
+	in := sort.Search(n, func(in int) bool {
+		ts, _, _ := i.Read(int64(in))
+		return ts >= timestamp
+	})
+	if in == n {
+		return 0, io.EOF
+	}
+
+	_, offset, err := i.Read(int64(in))
+	return offset, err
+}
+
+func (i *timeIndex) Write(timestamp int64, offset uint32) error {
+	if uint64(len(i.mmap)) < i.size+uint64(timeEntryWidth) {
+		return io.EOF
+	}
+
+	binary.BigEndian.PutUint64(i.mmap[i.size:i.size+uint64(timestampWidth)], uint64(timestamp))
+	binary.BigEndian.PutUint32(i.mmap[i.size+uint64(timestampWidth):i.size+uint64(timeEntryWidth)], offset)
+	i.size += uint64(timeEntryWidth)
+
+	return nil
+}
+
+// Close syncs the mapped entries to disk and truncates the file back to
+// the entries it holds, like index.Close.
+func (i *timeIndex) Close() error {
+	if err := i.mmap.Sync(gommap.MS_SYNC); err != nil {
+		return err
+	}
+
+	if err := i.file.Sync(); err != nil {
+		return err
+	}
+
+	if err := i.file.Truncate(int64(i.size)); err != nil {
+		return err
+	}
+
+	return i.file.Close()
+}
+
+func (i *timeIndex) Name() string {
+	return i.file.Name()
+}
@@ -0,0 +1,63 @@
+package log
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeIndex(t *testing.T) {
+	f, err := ioutil.TempFile("", "timeindex_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	idx, err := newTimeIndex(f, c)
+	require.NoError(t, err)
+
+	_, _, err = idx.Read(-1)
+	require.Equal(t, io.EOF, err)
+	_, err = idx.Lookup(0)
+	require.Equal(t, io.EOF, err)
+
+	entries := []struct {
+		Timestamp int64
+		Offset    uint32
+	}{
+		{Timestamp: 1000, Offset: 0},
+		{Timestamp: 2000, Offset: 4},
+		{Timestamp: 3000, Offset: 9},
+	}
+	for _, entry := range entries {
+		require.NoError(t, idx.Write(entry.Timestamp, entry.Offset))
+	}
+
+	// Lookups land on the first entry at or after the timestamp.
+	for timestamp, want := range map[int64]uint32{
+		0:    0,
+		1000: 0,
+		1500: 4,
+		3000: 9,
+	} {
+		off, err := idx.Lookup(timestamp)
+		require.NoError(t, err)
+		require.Equal(t, want, off)
+	}
+	_, err = idx.Lookup(3001)
+	require.Equal(t, io.EOF, err)
+	require.NoError(t, idx.Close())
+
+	// The index should build its state from the existing file.
+	f, _ = os.OpenFile(f.Name(), os.O_RDWR, 0600)
+	idx, err = newTimeIndex(f, c)
+	require.NoError(t, err)
+
+	ts, off, err := idx.Read(-1)
+	require.NoError(t, err)
+	require.Equal(t, int64(3000), ts)
+	require.Equal(t, uint32(9), off)
+}
@@ -0,0 +1,413 @@
+package log
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	api "github.com/hindenbug/dlog/api/log/v1"
+)
+
+// DefaultTopic is the topic requests that don't name one go to. It's
+// created along with the registry.
+const DefaultTopic = "default"
+
+// MaxPartitions is the most partitions a topic can have. Each one is a log
+// with its own files and cleaner.
+const MaxPartitions = 1024
+
+var topicName = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,249}$`)
+
+// TopicsConfig configures a topic registry.
+type TopicsConfig struct {
+	// Log configures every partition's log. An archiver is shared between
+	// the partitions, each storing its files under its topic's name and
+	// its number.
+	Log Config
+	// CleanInterval is how often each partition's Cleaner runs.
+	CleanInterval time.Duration
+	// Partitions is the number of partitions topics are created with when
+	// no number is given. One if zero.
+	Partitions uint32
+}
+
+// Topics is a registry of named topics. Each topic is a subdirectory of
+// Dir named after it, holding one Log per partition in subdirectories
+// named after the partitions' numbers. Every log has a Cleaner applying
+// its retention policies for as long as it's open.
+type Topics struct {
+	Dir    string
+	Config TopicsConfig
+
+	mu     sync.RWMutex
+	topics map[string]*Topic
+}
+
+// Topic is a named set of partitions, each an independent log. Records
+// with the same key go to the same partition, so they keep their order.
+type Topic struct {
+	Name string
+
+	partitions []*partition
+	// next is the partition the next record without a key goes to.
+	next uint32
+}
+
+type partition struct {
+	log     *Log
+	cleaner *Cleaner
+}
+
+// NewTopics opens the topics found in dir, creating the default topic if
+// it doesn't exist yet. A log kept directly in dir, as before there were
+// topics, becomes partition 0 of the default topic.
+func NewTopics(dir string, c TopicsConfig) (*Topics, error) {
+	t := &Topics{
+		Dir:    dir,
+		Config: c,
+		topics: make(map[string]*Topic),
+	}
+
+	if err := migrateLog(dir, c.Log.Archive.Archiver); err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if !file.IsDir() || !validTopic(file.Name()) {
+			continue
+		}
+		n, err := countPartitions(path.Join(dir, file.Name()))
+		if err != nil {
+			t.Close()
+			return nil, err
+		}
+		if err = t.open(file.Name(), n); err != nil {
+			t.Close()
+			return nil, err
+		}
+	}
+
+	if _, ok := t.topics[DefaultTopic]; !ok {
+		if _, err = t.Create(DefaultTopic, 0); err != nil {
+			t.Close()
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+// migrateLog moves the segments of a log kept directly in dir into
+// partition 0 of the default topic. Archived segments' files are copied to
+// the names the partition stores them under before their markers move, and
+// only deleted from their old names once every segment has moved, so a
+// migration that's cut short carries on at the next start.
+func migrateLog(dir string, archiver SegmentArchiver) error {
+	baseOffsets, archived, err := readBaseOffsets(dir)
+	if err != nil {
+		return err
+	}
+	if len(baseOffsets) == 0 {
+		return nil
+	}
+	if len(archived) > 0 && archiver == nil {
+		return fmt.Errorf("%s: log has archived segments, which can't be moved into topic %q without the archiver", dir, DefaultTopic)
+	}
+
+	to := path.Join(dir, DefaultTopic, "0")
+	if err = os.MkdirAll(to, 0755); err != nil {
+		return err
+	}
+	segmentExts := []string{".store", ".index", ".timeindex"}
+	for _, off := range baseOffsets {
+		s := &segment{dir: dir, baseOffset: off}
+		if archived[off] {
+			prefixed := &prefixArchiver{archiver, fmt.Sprintf("%s/%d/", DefaultTopic, 0)}
+			for _, ext := range segmentExts {
+				if err = copyArchived(archiver, prefixed, s.name(ext)); err != nil {
+					return err
+				}
+			}
+		}
+		for _, ext := range append(segmentExts, archivedExt) {
+			err = os.Rename(s.path(ext), path.Join(to, s.name(ext)))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	// The old log's cache and an unfinished rewrite would otherwise be
+	// taken for topics.
+	for _, name := range []string{cacheDir, rewriteDir} {
+		if err = os.RemoveAll(path.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+
+	for off := range archived {
+		s := &segment{dir: dir, baseOffset: off}
+		for _, ext := range segmentExts {
+			if err = archiver.Delete(s.name(ext)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// copyArchived copies the file stored under name in one archiver to the
+// same name in another.
+func copyArchived(from, to SegmentArchiver, name string) error {
+	r, err := from.Get(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return to.Put(name, r)
+}
+
+func validTopic(name string) bool {
+	return topicName.MatchString(name) && name != "." && name != ".."
+}
+
+// countPartitions returns the number of partitions in the topic's
+// directory. They're numbered from zero without gaps.
+func countPartitions(dir string) (uint32, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	seen := make(map[uint64]bool)
+	for _, file := range files {
+		if !file.IsDir() {
+			continue
+		}
+		p, err := strconv.ParseUint(file.Name(), 10, 32)
+		if err != nil {
+			continue
+		}
+		seen[p] = true
+	}
+	for p := range seen {
+		if p >= uint64(len(seen)) {
+			return 0, fmt.Errorf("topic is missing partitions: %s", dir)
+		}
+	}
+	if len(seen) == 0 {
+		return 0, fmt.Errorf("topic has no partitions: %s", dir)
+	}
+
+	return uint32(len(seen)), nil
+}
+
+// open opens the logs of an existing topic's partitions and starts their
+// cleaners. It must be called with t.mu held.
+func (t *Topics) open(name string, partitions uint32) error {
+	topic := &Topic{Name: name}
+	for p := uint32(0); p < partitions; p++ {
+		dir := path.Join(t.Dir, name, strconv.FormatUint(uint64(p), 10))
+
+		c := t.Config.Log
+		if archiver := c.Archive.Archiver; archiver != nil {
+			c.Archive.Archiver = &prefixArchiver{archiver, fmt.Sprintf("%s/%d/", name, p)}
+		}
+
+		log, err := NewLog(dir, c)
+		if err != nil {
+			topic.close()
+			return err
+		}
+
+		cleaner := &Cleaner{Log: log, Interval: t.Config.CleanInterval}
+		cleaner.Start()
+		topic.partitions = append(topic.partitions, &partition{log: log, cleaner: cleaner})
+	}
+	t.topics[name] = topic
+
+	return nil
+}
+
+// Create creates a topic with the given number of partitions, or the
+// configured default if zero.
+func (t *Topics) Create(name string, partitions uint32) (*Topic, error) {
+	if !validTopic(name) {
+		return nil, api.ErrInvalidTopic{Topic: name}
+	}
+	if partitions == 0 {
+		partitions = t.Config.Partitions
+	}
+	if partitions == 0 {
+		partitions = 1
+	}
+	if partitions > MaxPartitions {
+		return nil, api.ErrTooManyPartitions{Partitions: partitions, Max: MaxPartitions}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.topics[name]; ok {
+		return nil, api.ErrTopicExists{Topic: name}
+	}
+	if err := os.Mkdir(path.Join(t.Dir, name), 0755); err != nil {
+		return nil, err
+	}
+	for p := uint32(0); p < partitions; p++ {
+		dir := path.Join(t.Dir, name, strconv.FormatUint(uint64(p), 10))
+		if err := os.Mkdir(dir, 0755); err != nil {
+			os.RemoveAll(path.Join(t.Dir, name))
+			return nil, err
+		}
+	}
+	if err := t.open(name, partitions); err != nil {
+		os.RemoveAll(path.Join(t.Dir, name))
+		return nil, err
+	}
+
+	return t.topics[name], nil
+}
+
+// Get returns the topic with the given name, or the default topic if name
+// is empty.
+func (t *Topics) Get(name string) (*Topic, error) {
+	if name == "" {
+		name = DefaultTopic
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	topic, ok := t.topics[name]
+	if !ok {
+		return nil, api.ErrTopicNotFound{Topic: name}
+	}
+
+	return topic, nil
+}
+
+// Delete removes the topic and all of its records. Requests still using
+// its logs fail once they're removed. The default topic can't be deleted.
+func (t *Topics) Delete(name string) error {
+	if name == "" || name == DefaultTopic {
+		return api.ErrDefaultTopic{}
+	}
+
+	t.mu.Lock()
+	topic, ok := t.topics[name]
+	delete(t.topics, name)
+	t.mu.Unlock()
+
+	if !ok {
+		return api.ErrTopicNotFound{Topic: name}
+	}
+	for _, p := range topic.partitions {
+		if err := p.cleaner.Close(); err != nil {
+			return err
+		}
+		if err := p.log.Remove(); err != nil {
+			return err
+		}
+	}
+
+	return os.RemoveAll(path.Join(t.Dir, name))
+}
+
+// List returns the names of the topics, sorted.
+func (t *Topics) List() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	names := make([]string, 0, len(t.topics))
+	for name := range t.topics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Sync fsyncs every partition's log.
+func (t *Topics) Sync() error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	for _, topic := range t.topics {
+		for _, p := range topic.partitions {
+			if err := p.log.Sync(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Close stops the partitions' cleaners and closes their logs.
+func (t *Topics) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, topic := range t.topics {
+		if err := topic.close(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Partitions returns the number of partitions the topic has.
+func (t *Topic) Partitions() uint32 {
+	return uint32(len(t.partitions))
+}
+
+// Partition returns the log of the given partition.
+func (t *Topic) Partition(p uint32) (*Log, error) {
+	if p >= t.Partitions() {
+		return nil, api.ErrPartitionNotFound{Topic: t.Name, Partition: p}
+	}
+
+	return t.partitions[p].log, nil
+}
+
+// PartitionFor returns the partition a record with the given key goes to:
+// the FNV-1a hash of the key modulo the number of partitions. Records
+// without a key go to each partition in turn.
+func (t *Topic) PartitionFor(key []byte) uint32 {
+	if len(key) == 0 {
+		return (atomic.AddUint32(&t.next, 1) - 1) % t.Partitions()
+	}
+
+	h := fnv.New32a()
+	h.Write(key)
+	return h.Sum32() % t.Partitions()
+}
+
+func (t *Topic) close() error {
+	for _, p := range t.partitions {
+		if err := p.cleaner.Close(); err != nil {
+			return err
+		}
+		if err := p.log.Close(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,196 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	api "github.com/hindenbug/dlog/api/log/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "topics-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := TopicsConfig{}
+	c.Log.Segment.MaxStoreBytes = 100
+	c.Log.Archive.Archiver = &LocalArchiver{Dir: path.Join(dir, "archive")}
+	topics, err := NewTopics(path.Join(dir, "topics"), c)
+	require.Error(t, err)
+
+	require.NoError(t, os.Mkdir(path.Join(dir, "topics"), 0755))
+	topics, err = NewTopics(path.Join(dir, "topics"), c)
+	require.NoError(t, err)
+	require.Equal(t, []string{DefaultTopic}, topics.List())
+
+	topic, err := topics.Create("orders", 0)
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), topic.Partitions())
+	_, err = topics.Create("orders", 0)
+	require.Equal(t, api.ErrTopicExists{Topic: "orders"}, err)
+	_, err = topics.Create("..", 0)
+	require.Equal(t, api.ErrInvalidTopic{Topic: ".."}, err)
+	_, err = topics.Create("huge", MaxPartitions+1)
+	require.Equal(t, api.ErrTooManyPartitions{Partitions: MaxPartitions + 1, Max: MaxPartitions}, err)
+	require.Equal(t, []string{DefaultTopic, "orders"}, topics.List())
+
+	orders, err := topic.Partition(0)
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		_, err = orders.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	// Each partition archives its segments under its topic's name and its
+	// number.
+	require.NoError(t, orders.Archive())
+	_, err = os.Stat(path.Join(dir, "archive", "orders", "0", "0.store"))
+	require.NoError(t, err)
+
+	require.NoError(t, topics.Close())
+
+	topics, err = NewTopics(path.Join(dir, "topics"), c)
+	require.NoError(t, err)
+	defer topics.Close()
+	require.Equal(t, []string{DefaultTopic, "orders"}, topics.List())
+
+	topic, err = topics.Get("orders")
+	require.NoError(t, err)
+	orders, err = topic.Partition(0)
+	require.NoError(t, err)
+	highest, err := orders.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), highest)
+
+	topic, err = topics.Get("")
+	require.NoError(t, err)
+	require.Equal(t, DefaultTopic, topic.Name)
+	log, err := topic.Partition(0)
+	require.NoError(t, err)
+	_, err = log.HighestOffset()
+	require.Equal(t, api.ErrLogEmpty{}, err)
+
+	require.Equal(t, api.ErrDefaultTopic{}, topics.Delete(DefaultTopic))
+	require.Equal(t, api.ErrDefaultTopic{}, topics.Delete(""))
+	require.NoError(t, topics.Delete("orders"))
+	_, err = topics.Get("orders")
+	require.Equal(t, api.ErrTopicNotFound{Topic: "orders"}, err)
+	_, err = orders.Append(&api.Record{Value: []byte("hello world")})
+	require.Equal(t, os.ErrClosed, err)
+	require.Equal(t, []string{DefaultTopic}, topics.List())
+	_, err = os.Stat(path.Join(dir, "archive", "orders", "0", "0.store"))
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(path.Join(dir, "topics", "orders"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestTopicPartitions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "topic-partitions-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	topics, err := NewTopics(dir, TopicsConfig{Partitions: 3})
+	require.NoError(t, err)
+
+	topic, err := topics.Get(DefaultTopic)
+	require.NoError(t, err)
+	require.Equal(t, uint32(3), topic.Partitions())
+	topic, err = topics.Create("orders", 4)
+	require.NoError(t, err)
+	require.Equal(t, uint32(4), topic.Partitions())
+	_, err = topic.Partition(4)
+	require.Equal(t, api.ErrPartitionNotFound{Topic: "orders", Partition: 4}, err)
+
+	// A key always goes to the same partition.
+	for _, key := range []string{"a", "b", "c", "d"} {
+		p := topic.PartitionFor([]byte(key))
+		require.Less(t, p, uint32(4))
+		require.Equal(t, p, topic.PartitionFor([]byte(key)))
+	}
+
+	// Records without a key go to each partition in turn.
+	seen := make(map[uint32]bool)
+	for i := 0; i < 4; i++ {
+		seen[topic.PartitionFor(nil)] = true
+	}
+	require.Len(t, seen, 4)
+
+	// Each partition has offsets of its own.
+	for p := uint32(0); p < 4; p++ {
+		log, err := topic.Partition(p)
+		require.NoError(t, err)
+		off, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), off)
+	}
+	require.NoError(t, topics.Close())
+
+	topics, err = NewTopics(dir, TopicsConfig{})
+	require.NoError(t, err)
+	topic, err = topics.Get("orders")
+	require.NoError(t, err)
+	require.Equal(t, uint32(4), topic.Partitions())
+	require.NoError(t, topics.Close())
+
+	// A topic with a partition missing doesn't open.
+	require.NoError(t, os.RemoveAll(path.Join(dir, "orders", "1")))
+	_, err = NewTopics(dir, TopicsConfig{})
+	require.Error(t, err)
+}
+
+func TestTopicsMigrateLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "topics-migrate-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	dataDir := path.Join(dir, "data")
+	require.NoError(t, os.Mkdir(dataDir, 0755))
+	archiver := &LocalArchiver{Dir: path.Join(dir, "archive")}
+
+	// A log kept directly in the data directory, some of it archived.
+	c := TopicsConfig{}
+	c.Log.Segment.MaxStoreBytes = 100
+	c.Log.Archive.Archiver = archiver
+	log, err := NewLog(dataDir, c.Log)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Archive())
+	_, err = log.Read(0)
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	topics, err := NewTopics(dataDir, c)
+	require.NoError(t, err)
+	defer topics.Close()
+	require.Equal(t, []string{DefaultTopic}, topics.List())
+
+	topic, err := topics.Get(DefaultTopic)
+	require.NoError(t, err)
+	log, err = topic.Partition(0)
+	require.NoError(t, err)
+	for off := uint64(0); off < 10; off++ {
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, read.Offset)
+	}
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), off)
+
+	// Nothing is left where the log used to be.
+	files, err := ioutil.ReadDir(dataDir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	files, err = ioutil.ReadDir(archiver.Dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	require.Equal(t, DefaultTopic, files[0].Name())
+}
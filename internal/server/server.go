@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"io"
 	"time"
 
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
@@ -9,6 +10,7 @@ import (
 	grpc_zap "github.com/grpc-ecosystem/go-grpc-middleware/logging/zap"
 	grpc_ctxtags "github.com/grpc-ecosystem/go-grpc-middleware/tags"
 	api "github.com/hindenbug/dlog/api/log/v1"
+	"github.com/hindenbug/dlog/internal/log"
 	"go.opencensus.io/plugin/ocgrpc"
 	"go.opencensus.io/stats/view"
 	"go.opencensus.io/trace"
@@ -19,17 +21,44 @@ import (
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
 type Config struct {
-	CommitLog  CommitLog
+	Topics     Topics
 	Authorizer Authorizer
+	// MaxInFlight is how many requests a ProduceStream reads ahead of the
+	// one it's appending. Once that many are waiting, it stops reading
+	// them, so a client outpacing the disk is held back instead of piling
+	// requests up in memory. DefaultMaxInFlight if zero.
+	MaxInFlight int
+	// MaxConsumeRecords is the most records a long-polling Consume returns,
+	// however many the request asks for. DefaultMaxConsumeRecords if zero.
+	MaxConsumeRecords uint32
+	// MaxConsumeWait is the longest a long-polling Consume waits for
+	// records. DefaultMaxConsumeWait if zero.
+	MaxConsumeWait time.Duration
+	// MaxResponseBytes is the most bytes of encoded records a response
+	// holds, though it always holds at least one record. It has to stay
+	// below the largest message the transport takes, 4MB by default for
+	// gRPC clients. DefaultMaxResponseBytes if zero.
+	MaxResponseBytes int
 }
 
+const DefaultMaxInFlight = 64
+
+const (
+	DefaultMaxConsumeRecords = 10000
+	DefaultMaxConsumeWait    = 30 * time.Second
+	DefaultMaxResponseBytes  = 3 << 20
+)
+
+// Requests are authorized with the topic they're for as the object.
+// Creating and deleting topics takes the manage action on the topic.
 const (
-	objectWildCard = "*"
-	produceAction  = "produce"
-	consumeAction  = "consume"
+	produceAction = "produce"
+	consumeAction = "consume"
+	manageAction  = "manage"
 )
 
 type Authorizer interface {
@@ -90,75 +119,484 @@ func newgrpcServer(config *Config) (srvr *grpcServer, err error) {
 }
 
 func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error) {
-	if err := s.Authorizer.Authorize(subject(ctx), objectWildCard, produceAction); err != nil {
+	topic, err := s.topic(ctx, req.Topic, produceAction)
+	if err != nil {
+		return nil, err
+	}
+
+	var partition uint32
+	if req.Partition != nil {
+		partition = *req.Partition
+	} else {
+		partition = topic.PartitionFor(req.Record.GetKey())
+	}
+	clog, err := topic.Partition(partition)
+	if err != nil {
+		return nil, err
+	}
+
+	offset, err := clog.Append(req.Record)
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.ProduceResponse{Offset: offset, Partition: partition}, nil
+}
+
+func (s *grpcServer) ProduceBatch(ctx context.Context, req *api.ProduceBatchRequest) (*api.ProduceBatchResponse, error) {
+	topic, err := s.topic(ctx, req.Topic, produceAction)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(req.Records) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "no records to produce")
+	}
+
+	partition, err := batchPartition(topic, req)
+	if err != nil {
+		return nil, err
+	}
+	clog, err := topic.Partition(partition)
+	if err != nil {
 		return nil, err
 	}
 
-	offset, err := s.CommitLog.Append(req.Record)
+	first, err := clog.AppendBatch(req.Records)
 	if err != nil {
 		return nil, err
 	}
 
-	return &api.ProduceResponse{Offset: offset}, nil
+	return &api.ProduceBatchResponse{
+		FirstOffset: first,
+		LastOffset:  first + uint64(len(req.Records)) - 1,
+		Partition:   partition,
+	}, nil
+}
+
+// batchPartition returns the partition the batch goes to. Without an
+// explicit partition, the keyed records have to agree on one so each key
+// stays in order, and a batch with no keys at all is routed as a whole.
+func batchPartition(topic *log.Topic, req *api.ProduceBatchRequest) (uint32, error) {
+	if req.Partition != nil {
+		return *req.Partition, nil
+	}
+
+	var (
+		partition uint32
+		keyed     bool
+	)
+	for _, record := range req.Records {
+		if len(record.Key) == 0 {
+			continue
+		}
+		p := topic.PartitionFor(record.Key)
+		if keyed && p != partition {
+			return 0, status.Error(codes.InvalidArgument, "batch records' keys hash to different partitions")
+		}
+		partition, keyed = p, true
+	}
+	if !keyed {
+		partition = topic.PartitionFor(nil)
+	}
+
+	return partition, nil
 }
 
 func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
-	if err := s.Authorizer.Authorize(subject(ctx), objectWildCard, consumeAction); err != nil {
+	clog, err := s.commitLog(ctx, req.Topic, req.Partition, consumeAction)
+	if err != nil {
 		return nil, err
 	}
 
-	record, err := s.CommitLog.Read(req.Offset)
+	if req.MaxWaitMs > 0 || req.MinRecords > 0 || req.MaxRecords > 0 {
+		return s.fetch(ctx, clog, req)
+	}
+
+	record, err := clog.Read(req.Offset)
 	if err != nil {
 		return nil, err
 	}
 
-	return &api.ConsumeResponse{Record: record}, nil
+	return &api.ConsumeResponse{Record: record, Records: []*api.Record{record}}, nil
 }
 
-func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
+// fetch reads up to req.MaxRecords records from req.Offset on, waiting up
+// to req.MaxWaitMs for req.MinRecords of them to be appended. It returns
+// whatever it has when the wait runs out, which may be nothing. The
+// server's limits cap the records, the wait and the response's size; a
+// response that's full is returned without waiting for more.
+func (s *grpcServer) fetch(ctx context.Context, clog CommitLog, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
+	limit := s.MaxConsumeRecords
+	if limit == 0 {
+		limit = DefaultMaxConsumeRecords
+	}
+	maxWait := s.MaxConsumeWait
+	if maxWait == 0 {
+		maxWait = DefaultMaxConsumeWait
+	}
+	maxBytes := s.maxResponseBytes()
+
+	minRecords := req.MinRecords
+	if minRecords == 0 {
+		minRecords = 1
+	}
+	maxRecords := req.MaxRecords
+	if maxRecords == 0 {
+		maxRecords = minRecords
+	}
+	if maxRecords > limit {
+		maxRecords = limit
+	}
+	if minRecords > maxRecords {
+		minRecords = maxRecords
+	}
+	wait := time.Duration(req.MaxWaitMs) * time.Millisecond
+	if wait > maxWait {
+		wait = maxWait
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+
+	it := clog.Iterator(req.Offset)
+	defer it.Close()
+
+	res := &api.ConsumeResponse{}
+	next := req.Offset
+	size := 0
+	full := false
 	for {
-		req, err := stream.Recv()
-		if err != nil {
-			return err
+		for uint32(len(res.Records)) < maxRecords && it.Next() {
+			record := it.Record()
+			n := proto.Size(record)
+			if len(res.Records) > 0 && size+n > maxBytes {
+				full = true
+				break
+			}
+			res.Records = append(res.Records, record)
+			size += n
+			next = record.Offset + 1
+		}
+		if err := it.Err(); err != nil {
+			return nil, err
 		}
+		if full || uint32(len(res.Records)) >= minRecords {
+			break
+		}
+
+		if err := clog.Wait(ctx, next); err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return nil, err
+		}
+	}
+
+	if len(res.Records) > 0 {
+		res.Record = res.Records[0]
+	}
+	return res, nil
+}
+
+// maxResponseBytes returns the most bytes of records a response holds.
+func (s *grpcServer) maxResponseBytes() int {
+	if s.MaxResponseBytes == 0 {
+		return DefaultMaxResponseBytes
+	}
+	return s.MaxResponseBytes
+}
 
-		res, err := s.Produce(stream.Context(), req)
+// ProduceStream reads requests while it appends earlier ones, so clients
+// can pipeline them. Requests are still appended, and responded to, one at
+// a time in the order they arrive.
+func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
+	maxInFlight := s.MaxInFlight
+	if maxInFlight == 0 {
+		maxInFlight = DefaultMaxInFlight
+	}
+
+	ctx := stream.Context()
+	reqs := make(chan *api.ProduceRequest, maxInFlight)
+	recvErr := make(chan error, 1)
+	go func() {
+		defer close(reqs)
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			select {
+			case reqs <- req:
+			case <-ctx.Done():
+				recvErr <- ctx.Err()
+				return
+			}
+		}
+	}()
+
+	for req := range reqs {
+		res, err := s.Produce(ctx, req)
 		if err != nil {
 			return err
 		}
+		res.Sequence = req.Sequence
 
 		if err = stream.Send(res); err != nil {
 			return err
 		}
 	}
+
+	if err := <-recvErr; err != io.EOF {
+		return err
+	}
+	return nil
 }
 
 func (s *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_ConsumeStreamServer) error {
+	clog, err := s.commitLog(stream.Context(), req.Topic, req.Partition, consumeAction)
+	if err != nil {
+		return err
+	}
+
+	if req.MaxBatchRecords > 0 || req.MaxBatchBytes > 0 {
+		return s.consumeBatches(stream, clog, req)
+	}
+
+	it := clog.Iterator(req.Offset)
+	defer it.Close()
+
+	ctx := stream.Context()
+	next := req.Offset
 	for {
-		select {
-		case <-stream.Context().Done():
-			return nil
-		default:
-			res, err := s.Consume(stream.Context(), req)
-			switch err.(type) {
-			case nil:
-			case api.ErrOffsetOutOfRange:
-				continue
-			default:
+		// Send everything appended so far, then wait for more.
+		for it.Next() {
+			record := it.Record()
+			if err := stream.Send(&api.ConsumeResponse{Record: record}); err != nil {
 				return err
 			}
+			next = record.Offset + 1
+		}
+		if err := it.Err(); err != nil {
+			return err
+		}
+
+		if err := clog.Wait(ctx, next); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// consumeBatches streams the records from req.Offset on in batches of up to
+// req.MaxBatchRecords records and req.MaxBatchBytes bytes. A batch is sent
+// as soon as it's full or the stream has caught up with the log. The
+// server's MaxResponseBytes caps the bytes, and applies when the request
+// doesn't set them.
+func (s *grpcServer) consumeBatches(stream api.Log_ConsumeStreamServer, clog CommitLog, req *api.ConsumeRequest) error {
+	maxBytes := s.maxResponseBytes()
+	if req.MaxBatchBytes > 0 && int(req.MaxBatchBytes) < maxBytes {
+		maxBytes = int(req.MaxBatchBytes)
+	}
+
+	it := clog.Iterator(req.Offset)
+	defer it.Close()
+
+	var (
+		batch []*api.Record
+		size  int
+	)
+	send := func() error {
+		err := stream.Send(&api.ConsumeResponse{Record: batch[0], Records: batch})
+		batch, size = nil, 0
+		return err
+	}
+
+	ctx := stream.Context()
+	next := req.Offset
+	for {
+		for it.Next() {
+			record := it.Record()
+			n := proto.Size(record)
+			if len(batch) > 0 && size+n > maxBytes {
+				if err := send(); err != nil {
+					return err
+				}
+			}
+			batch = append(batch, record)
+			size += n
+			next = record.Offset + 1
 
-			if err = stream.Send(res); err != nil {
+			if uint32(len(batch)) == req.MaxBatchRecords {
+				if err := send(); err != nil {
+					return err
+				}
+			}
+		}
+		if err := it.Err(); err != nil {
+			return err
+		}
+		if len(batch) > 0 {
+			if err := send(); err != nil {
 				return err
 			}
-			req.Offset++
 		}
+
+		if err := clog.Wait(ctx, next); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+func (s *grpcServer) GetOffsets(ctx context.Context, req *api.GetOffsetsRequest) (*api.GetOffsetsResponse, error) {
+	clog, err := s.commitLog(ctx, req.Topic, req.Partition, consumeAction)
+	if err != nil {
+		return nil, err
+	}
+
+	lowest, err := clog.LowestOffset()
+	if err != nil {
+		return nil, err
+	}
+
+	highest, err := clog.HighestOffset()
+	if _, ok := err.(api.ErrLogEmpty); ok {
+		return &api.GetOffsetsResponse{Lowest: lowest, Empty: true}, nil
+	}
+	if err != nil {
+		return nil, err
 	}
+
+	return &api.GetOffsetsResponse{Lowest: lowest, Highest: highest}, nil
+}
+
+func (s *grpcServer) OffsetForTime(ctx context.Context, req *api.OffsetForTimeRequest) (*api.OffsetForTimeResponse, error) {
+	clog, err := s.commitLog(ctx, req.Topic, req.Partition, consumeAction)
+	if err != nil {
+		return nil, err
+	}
+
+	offset, err := clog.OffsetForTime(time.UnixMilli(req.Timestamp))
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.OffsetForTimeResponse{Offset: offset}, nil
+}
+
+func (s *grpcServer) CreateTopic(ctx context.Context, req *api.CreateTopicRequest) (*api.CreateTopicResponse, error) {
+	if err := s.Authorizer.Authorize(subject(ctx), req.Topic, manageAction); err != nil {
+		return nil, err
+	}
+
+	if _, err := s.Topics.Create(req.Topic, req.Partitions); err != nil {
+		return nil, err
+	}
+
+	return &api.CreateTopicResponse{}, nil
+}
+
+func (s *grpcServer) DeleteTopic(ctx context.Context, req *api.DeleteTopicRequest) (*api.DeleteTopicResponse, error) {
+	if err := s.Authorizer.Authorize(subject(ctx), req.Topic, manageAction); err != nil {
+		return nil, err
+	}
+
+	if err := s.Topics.Delete(req.Topic); err != nil {
+		return nil, err
+	}
+
+	return &api.DeleteTopicResponse{}, nil
+}
+
+// ListTopics returns the topics the caller is allowed to consume from.
+func (s *grpcServer) ListTopics(ctx context.Context, req *api.ListTopicsRequest) (*api.ListTopicsResponse, error) {
+	res := &api.ListTopicsResponse{}
+	for _, name := range s.Topics.List() {
+		if s.Authorizer.Authorize(subject(ctx), name, consumeAction) != nil {
+			continue
+		}
+		topic, err := s.Topics.Get(name)
+		if err != nil {
+			// Deleted since it was listed.
+			continue
+		}
+		res.Topics = append(res.Topics, name)
+		res.Partitions = append(res.Partitions, topic.Partitions())
+	}
+
+	return res, nil
+}
+
+// topic authorizes the action on the topic and returns it. An empty topic
+// stands for the default topic.
+func (s *grpcServer) topic(ctx context.Context, name, action string) (*log.Topic, error) {
+	if name == "" {
+		name = log.DefaultTopic
+	}
+	if err := s.Authorizer.Authorize(subject(ctx), name, action); err != nil {
+		return nil, err
+	}
+
+	return s.Topics.Get(name)
+}
+
+// commitLog authorizes the action on the topic and returns the log of the
+// given partition.
+func (s *grpcServer) commitLog(ctx context.Context, name string, partition uint32, action string) (CommitLog, error) {
+	topic, err := s.topic(ctx, name, action)
+	if err != nil {
+		return nil, err
+	}
+
+	clog, err := topic.Partition(partition)
+	if err != nil {
+		return nil, err
+	}
+
+	return partitionLog{clog}, nil
+}
+
+// Topics is the registry of the topics the server serves.
+type Topics interface {
+	Create(string, uint32) (*log.Topic, error)
+	Get(string) (*log.Topic, error)
+	Delete(string) error
+	List() []string
 }
 
 type CommitLog interface {
 	Append(*api.Record) (uint64, error)
+	AppendBatch([]*api.Record) (uint64, error)
 	Read(uint64) (*api.Record, error)
+	Iterator(uint64) RecordIterator
+	Wait(context.Context, uint64) error
+	LowestOffset() (uint64, error)
+	HighestOffset() (uint64, error)
+	OffsetForTime(time.Time) (uint64, error)
+}
+
+// RecordIterator walks a commit log's records in offset order. Next
+// returns false at the end of the log or on an error, which Err returns.
+type RecordIterator interface {
+	Next() bool
+	Record() *api.Record
+	Err() error
+	Close() error
+}
+
+// partitionLog serves a topic partition's log as a CommitLog.
+type partitionLog struct {
+	*log.Log
+}
+
+func (l partitionLog) Iterator(from uint64) RecordIterator {
+	return l.Log.Iterator(from)
 }
 
 func authenticate(ctx context.Context) (context.Context, error) {
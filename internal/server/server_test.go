@@ -3,9 +3,11 @@ package server
 import (
 	"context"
 	"flag"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -47,6 +49,15 @@ func TestServer(t *testing.T) {
 		"consume past log boundary fails":                     testConsumePastBoundary,
 		"produce/consume stream succeeds":                     testProduceConsumeStream,
 		"unauthorized requests fails":                         testUnauthorized,
+		"get offsets returns the log's bounds":                testGetOffsets,
+		"offset for time finds the first record after a time": testOffsetForTime,
+		"keys, headers and timestamps pass through":           testRecordMetadata,
+		"produce batch appends every record":                  testProduceBatch,
+		"topics are created, listed and deleted":              testTopics,
+		"records are routed to partitions":                    testPartitions,
+		"consume long-polls for records":                      testConsumeLongPoll,
+		"consume stream sends batches":                        testConsumeStreamBatches,
+		"produce stream pipelines requests":                   testProduceStreamPipelined,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			rootClient, nobodyClient, config, teardown := setupTest(t, nil)
@@ -78,7 +89,7 @@ func setupClient(t *testing.T, serverAddress, clientKeyFile, clientCertFile stri
 	}
 }
 
-func setupServer(t *testing.T, serverConfig *Config) (serverAddress string, teardown func()) {
+func setupServer(t *testing.T, serverConfig *Config, opts ...grpc.ServerOption) (serverAddress string, teardown func()) {
 	t.Helper()
 
 	l, err := net.Listen("tcp", "127.0.0.1:0")
@@ -95,7 +106,7 @@ func setupServer(t *testing.T, serverConfig *Config) (serverAddress string, tear
 	require.NoError(t, err)
 	serverCreds := credentials.NewTLS(serverTLSConfig)
 
-	server, err := NewGRPCServer(serverConfig, grpc.Creds(serverCreds))
+	server, err := NewGRPCServer(serverConfig, append(opts, grpc.Creds(serverCreds))...)
 	require.NoError(t, err)
 
 	go func() {
@@ -150,12 +161,12 @@ func setupTest(t *testing.T, fn func(*Config)) (
 	dir, err := ioutil.TempDir("", "server-test")
 	require.NoError(t, err)
 
-	clog, err := log.NewLog(dir, log.Config{})
+	topics, err := log.NewTopics(dir, log.TopicsConfig{})
 	require.NoError(t, err)
 
 	authorizer := auth.New(config.ACLModelFile, config.ACLPolicyFile)
 	cfg = &Config{
-		CommitLog:  clog,
+		Topics:     topics,
 		Authorizer: authorizer,
 	}
 
@@ -172,7 +183,7 @@ func setupTest(t *testing.T, fn func(*Config)) (
 		rootClientTeardown()
 		nobodyClientTeardown()
 		serverTeardown()
-		//clog.Remove()
+		topics.Close()
 		telemetryTeardown()
 	}
 }
@@ -247,10 +258,21 @@ func testProduceConsumeStream(t *testing.T, client, _ api.LogClient, config *Con
 		for i, record := range records {
 			res, err := stream.Recv()
 			require.NoError(t, err)
+			require.NotZero(t, res.Record.Timestamp)
 			require.Equal(t, res.Record, &api.Record{
 				Value: record.Value, Offset: uint64(i),
+				Timestamp: res.Record.Timestamp,
 			})
 		}
+
+		// At the end of the log the stream waits for the next append.
+		_, err = client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("third message")},
+		})
+		require.NoError(t, err)
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, uint64(2), res.Record.Offset)
 	}
 }
 
@@ -283,3 +305,476 @@ func testUnauthorized(t *testing.T, _, client api.LogClient, config *Config) {
 		t.Fatalf("got code: %d, expected: %d", statusCode, expectedCode)
 	}
 }
+
+func testGetOffsets(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	offsets, err := client.GetOffsets(ctx, &api.GetOffsetsRequest{})
+	require.NoError(t, err)
+	require.True(t, offsets.Empty)
+	require.Equal(t, uint64(0), offsets.Lowest)
+
+	for i := 0; i < 3; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+
+	offsets, err = client.GetOffsets(ctx, &api.GetOffsetsRequest{})
+	require.NoError(t, err)
+	require.False(t, offsets.Empty)
+	require.Equal(t, uint64(0), offsets.Lowest)
+	require.Equal(t, uint64(2), offsets.Highest)
+}
+
+func testOffsetForTime(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	for i := int64(1); i <= 3; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world"), Timestamp: i * 1000},
+		})
+		require.NoError(t, err)
+	}
+
+	res, err := client.OffsetForTime(ctx, &api.OffsetForTimeRequest{Timestamp: 1500})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), res.Offset)
+}
+
+func testRecordMetadata(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	record := &api.Record{
+		Key:       []byte("user-42"),
+		Value:     []byte("hello world"),
+		Headers:   []*api.Header{{Key: "content-type", Value: []byte("text/plain")}},
+		Timestamp: 1630486800000,
+	}
+
+	produce, err := client.Produce(ctx, &api.ProduceRequest{Record: record})
+	require.NoError(t, err)
+
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+	require.Equal(t, record.Key, consume.Record.Key)
+	require.Equal(t, record.Timestamp, consume.Record.Timestamp)
+	require.Len(t, consume.Record.Headers, 1)
+	require.Equal(t, "content-type", consume.Record.Headers[0].Key)
+	require.Equal(t, []byte("text/plain"), consume.Record.Headers[0].Value)
+}
+
+func testProduceBatch(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	records := []*api.Record{
+		{Value: []byte("first message")},
+		{Value: []byte("second message")},
+		{Value: []byte("third message")},
+	}
+	res, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{Records: records})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.FirstOffset)
+	require.Equal(t, uint64(2), res.LastOffset)
+
+	for i, record := range records {
+		consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: uint64(i)})
+		require.NoError(t, err)
+		require.Equal(t, record.Value, consume.Record.Value)
+	}
+
+	_, err = client.ProduceBatch(ctx, &api.ProduceBatchRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func testTopics(t *testing.T, client, nobodyClient api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	_, err := client.CreateTopic(ctx, &api.CreateTopicRequest{Topic: "orders"})
+	require.NoError(t, err)
+	_, err = client.CreateTopic(ctx, &api.CreateTopicRequest{Topic: "orders"})
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+	_, err = client.CreateTopic(ctx, &api.CreateTopicRequest{Topic: "../orders"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = nobodyClient.CreateTopic(ctx, &api.CreateTopicRequest{Topic: "payments"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	list, err := client.ListTopics(ctx, &api.ListTopicsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, []string{log.DefaultTopic, "orders"}, list.Topics)
+	list, err = nobodyClient.ListTopics(ctx, &api.ListTopicsRequest{})
+	require.NoError(t, err)
+	require.Empty(t, list.Topics)
+
+	// Topics have offsets of their own.
+	for _, topic := range []string{"", "orders", "orders"} {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Topic:  topic,
+			Record: &api.Record{Value: []byte(topic)},
+		})
+		require.NoError(t, err)
+	}
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Topic: "orders", Offset: 1})
+	require.NoError(t, err)
+	require.Equal(t, []byte("orders"), consume.Record.Value)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 1})
+	require.Equal(t, status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err()), status.Code(err))
+
+	_, err = client.DeleteTopic(ctx, &api.DeleteTopicRequest{Topic: "orders"})
+	require.NoError(t, err)
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Topic:  "orders",
+		Record: &api.Record{Value: []byte("orders")},
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.DeleteTopic(ctx, &api.DeleteTopicRequest{Topic: "orders"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.DeleteTopic(ctx, &api.DeleteTopicRequest{Topic: log.DefaultTopic})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func testPartitions(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	_, err := client.CreateTopic(ctx, &api.CreateTopicRequest{Topic: "orders", Partitions: 4})
+	require.NoError(t, err)
+	list, err := client.ListTopics(ctx, &api.ListTopicsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, []uint32{1, 4}, list.Partitions)
+
+	// Records with the same key end up in the same partition, in order.
+	var partition uint32
+	for i := 0; i < 3; i++ {
+		produce, err := client.Produce(ctx, &api.ProduceRequest{
+			Topic:  "orders",
+			Record: &api.Record{Key: []byte("customer-1"), Value: []byte{byte(i)}},
+		})
+		require.NoError(t, err)
+		if i > 0 {
+			require.Equal(t, partition, produce.Partition)
+		}
+		partition = produce.Partition
+		require.Equal(t, uint64(i), produce.Offset)
+	}
+	for i := 0; i < 3; i++ {
+		consume, err := client.Consume(ctx, &api.ConsumeRequest{
+			Topic:     "orders",
+			Partition: partition,
+			Offset:    uint64(i),
+		})
+		require.NoError(t, err)
+		require.Equal(t, []byte{byte(i)}, consume.Record.Value)
+	}
+
+	// An explicit partition overrides the key.
+	other := (partition + 1) % 4
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Topic:     "orders",
+		Partition: &other,
+		Record:    &api.Record{Key: []byte("customer-1"), Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	require.Equal(t, other, produce.Partition)
+	require.Equal(t, uint64(0), produce.Offset)
+
+	batch, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{
+		Topic: "orders",
+		Records: []*api.Record{
+			{Key: []byte("customer-1"), Value: []byte("hello")},
+			{Value: []byte("world")},
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, partition, batch.Partition)
+	require.Equal(t, uint64(3), batch.FirstOffset)
+
+	missing := uint32(4)
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Topic:     "orders",
+		Partition: &missing,
+		Record:    &api.Record{Value: []byte("hello world")},
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Topic: "orders", Partition: missing})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func testConsumeLongPoll(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte{byte(i)}},
+		})
+		require.NoError(t, err)
+	}
+
+	// Records already in the log are returned right away, up to the max.
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 1, MaxRecords: 5})
+	require.NoError(t, err)
+	require.Len(t, consume.Records, 2)
+	require.Equal(t, uint64(1), consume.Record.Offset)
+	require.Equal(t, uint64(2), consume.Records[1].Offset)
+
+	consume, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 0, MaxRecords: 2})
+	require.NoError(t, err)
+	require.Len(t, consume.Records, 2)
+
+	// Past the end of the log, the request returns empty once the wait
+	// runs out.
+	start := time.Now()
+	consume, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 3, MaxWaitMs: 50})
+	require.NoError(t, err)
+	require.Empty(t, consume.Records)
+	require.Nil(t, consume.Record)
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	// The request is held until min records are appended.
+	produced := make(chan error)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		for i := 3; i < 5; i++ {
+			_, err := client.Produce(ctx, &api.ProduceRequest{
+				Record: &api.Record{Value: []byte{byte(i)}},
+			})
+			if err != nil {
+				produced <- err
+				return
+			}
+		}
+		produced <- nil
+	}()
+	consume, err = client.Consume(ctx, &api.ConsumeRequest{
+		Offset:     3,
+		MaxWaitMs:  5000,
+		MinRecords: 2,
+		MaxRecords: 10,
+	})
+	require.NoError(t, err)
+	require.NoError(t, <-produced)
+	require.Len(t, consume.Records, 2)
+	require.Equal(t, []byte{4}, consume.Records[1].Value)
+
+	// Without any of the long-poll fields, reading past the end still
+	// fails.
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 5})
+	require.Equal(t, status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err()), status.Code(err))
+}
+
+func TestConsumeLimits(t *testing.T) {
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		c.MaxConsumeRecords = 2
+		c.MaxConsumeWait = 50 * time.Millisecond
+		c.MaxResponseBytes = 1000
+	})
+	defer teardown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, value := range [][]byte{{0}, {1}, {2}, make([]byte, 600), make([]byte, 600)} {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: value},
+		})
+		require.NoError(t, err)
+	}
+
+	// The server caps the records a request asks for.
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{MaxRecords: 10})
+	require.NoError(t, err)
+	require.Len(t, consume.Records, 2)
+
+	// And how long it waits.
+	start := time.Now()
+	consume, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 5, MaxWaitMs: 60000})
+	require.NoError(t, err)
+	require.Empty(t, consume.Records)
+	require.Less(t, time.Since(start), 5*time.Second)
+
+	// Batches are capped too, even when only the records are limited.
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 3, MaxBatchRecords: 2})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Len(t, res.Records, 1)
+
+	// A response that can't take another record is returned, even short
+	// of min records.
+	consume, err = client.Consume(ctx, &api.ConsumeRequest{
+		Offset:     3,
+		MinRecords: 2,
+		MaxRecords: 2,
+		MaxWaitMs:  60000,
+	})
+	require.NoError(t, err)
+	require.Len(t, consume.Records, 1)
+	require.Equal(t, uint64(3), consume.Record.Offset)
+}
+
+func testConsumeStreamBatches(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	records := make([]*api.Record, 5)
+	for i := range records {
+		records[i] = &api.Record{Value: []byte("hello world")}
+	}
+	_, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{Records: records})
+	require.NoError(t, err)
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{MaxBatchRecords: 2})
+	require.NoError(t, err)
+	var offsets []uint64
+	for _, want := range []int{2, 2, 1} {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Len(t, res.Records, want)
+		require.Equal(t, res.Records[0], res.Record)
+		for _, record := range res.Records {
+			offsets = append(offsets, record.Offset)
+		}
+	}
+	require.Equal(t, []uint64{0, 1, 2, 3, 4}, offsets)
+
+	// A batch holds at least one record however small the byte limit is.
+	stream, err = client.ConsumeStream(ctx, &api.ConsumeRequest{MaxBatchBytes: 1})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Len(t, res.Records, 1)
+
+	stream, err = client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 1, MaxBatchBytes: 1000})
+	require.NoError(t, err)
+	res, err = stream.Recv()
+	require.NoError(t, err)
+	require.Len(t, res.Records, 4)
+}
+
+func testProduceStreamPipelined(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	stream, err := client.ProduceStream(ctx)
+	require.NoError(t, err)
+
+	// Send more requests than the server reads ahead before reading any
+	// responses.
+	n := DefaultMaxInFlight * 2
+	for i := 0; i < n; i++ {
+		err := stream.Send(&api.ProduceRequest{
+			Record:   &api.Record{Value: []byte("hello world")},
+			Sequence: uint64(100 + i),
+		})
+		require.NoError(t, err)
+	}
+	require.NoError(t, stream.CloseSend())
+
+	for i := 0; i < n; i++ {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, uint64(100+i), res.Sequence)
+		require.Equal(t, uint64(i), res.Offset)
+	}
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+
+	// A failed request ends the stream with its error.
+	stream, err = client.ProduceStream(ctx)
+	require.NoError(t, err)
+	partition := uint32(1)
+	require.NoError(t, stream.Send(&api.ProduceRequest{
+		Record:    &api.Record{Value: []byte("hello world")},
+		Partition: &partition,
+		Sequence:  1,
+	}))
+	_, err = stream.Recv()
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+// blockingAuthorizer holds up produce requests until release is closed.
+type blockingAuthorizer struct {
+	Authorizer
+	release chan struct{}
+}
+
+func (a *blockingAuthorizer) Authorize(subject, object, action string) error {
+	if action == produceAction {
+		<-a.release
+	}
+	return a.Authorizer.Authorize(subject, object, action)
+}
+
+// countingStream counts the messages a server stream receives.
+type countingStream struct {
+	grpc.ServerStream
+	recvs *int32
+}
+
+func (s countingStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		atomic.AddInt32(s.recvs, 1)
+	}
+	return err
+}
+
+func TestProduceStreamBackpressure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "server-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	topics, err := log.NewTopics(dir, log.TopicsConfig{})
+	require.NoError(t, err)
+	defer topics.Close()
+
+	authorizer := &blockingAuthorizer{
+		Authorizer: auth.New(config.ACLModelFile, config.ACLPolicyFile),
+		release:    make(chan struct{}),
+	}
+	cfg := &Config{
+		Topics:      topics,
+		Authorizer:  authorizer,
+		MaxInFlight: 2,
+	}
+	var recvs int32
+	count := grpc.ChainStreamInterceptor(func(
+		srv interface{},
+		ss grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		return handler(srv, countingStream{ss, &recvs})
+	})
+	serverAddress, serverTeardown := setupServer(t, cfg, count)
+	defer serverTeardown()
+	client, clientTeardown := setupClient(t, serverAddress, config.RootClientKeyFile, config.RootClientCertFile)
+	defer clientTeardown()
+
+	stream, err := client.ProduceStream(context.Background())
+	require.NoError(t, err)
+	n := 20
+	for i := 0; i < n; i++ {
+		require.NoError(t, stream.Send(&api.ProduceRequest{
+			Record:   &api.Record{Value: []byte("hello world")},
+			Sequence: uint64(i),
+		}))
+	}
+
+	// While the first request's append is held up, the server reads
+	// MaxInFlight requests ahead of it, plus one waiting for room, and
+	// stops there.
+	want := int32(cfg.MaxInFlight + 2)
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&recvs) == want
+	}, time.Second, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, want, atomic.LoadInt32(&recvs))
+
+	close(authorizer.release)
+	require.NoError(t, stream.CloseSend())
+	for i := 0; i < n; i++ {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), res.Sequence)
+		require.Equal(t, uint64(i), res.Offset)
+	}
+}